@@ -0,0 +1,114 @@
+package linker
+
+import (
+	"fmt"
+	obj "koltrakak/my-linker/objectformat"
+	"slices"
+)
+
+/****** GRUPPI COMDAT ******/
+
+// Dei segmentini con la stessa chiave di gruppo (vedi obj.Segment) tengo solo
+// il primo che incontro nell'ordine degli input, gli altri li scarto: lunghezza
+// zero, niente dati e niente relocation, come quelli tolti da -gc-sections.
+//
+// Chi usa una copia scartata deve finire su quella tenuta. Per farlo nella
+// segmentAllocationTable, al posto della copia scartata, metto la copia tenuta:
+// le copie sono identiche, quindi un offset dentro una vale anche dentro l'altra
+// e i fixup e la risoluzione dei simboli del file della copia scartata vanno
+// automaticamente sulla copia tenuta. I simboli globali della copia scartata non
+// finiscono nella tabella globale, li definisce già la copia tenuta. Se la copia
+// tenuta non li definisce le copie non sono uguali e il link fallisce.
+
+// comdatCopy è una copia di un gruppo: un segmentino di un input
+type comdatCopy struct {
+	io  *obj.MyObjectFormat
+	seg *obj.Segment
+}
+
+type comdatGroups struct {
+	kept      map[string]comdatCopy // chiave del gruppo -> copia tenuta
+	discarded []comdatCopy
+}
+
+func newComdatGroups() *comdatGroups {
+	return &comdatGroups{kept: map[string]comdatCopy{}}
+}
+
+// keep dice se il segmentino seg di io va allocato. Se è una copia di un gruppo
+// già visto la scarta
+func (g *comdatGroups) keep(io *obj.MyObjectFormat, segIdx int) bool {
+	seg := io.SegmentTable[segIdx]
+	if seg.Group == "" {
+		return true
+	}
+	kept, ok := g.kept[seg.Group]
+	if !ok {
+		g.kept[seg.Group] = comdatCopy{io, seg}
+		return true
+	}
+
+	if seg.Length != kept.seg.Length {
+		// in teoria le copie sono uguali, se non lo sono qualcuno ha compilato
+		// lo stesso codice in modi diversi
+		fmt.Printf("### attenzione: la copia del gruppo %s in %s è lunga %d invece di %d come quella di %s\n",
+			seg.Group, io.Filename, seg.Length, kept.seg.Length, kept.io.Filename)
+	}
+	fmt.Printf("### comdat: scartato %s di %s, tengo quello di %s\n", seg.Name, io.Filename, kept.io.Filename)
+	seg.Length = 0
+	if segIdx < len(io.Data) {
+		io.Data[segIdx] = nil
+	}
+	var relocs []obj.RelocationEntry
+	for _, re := range io.RelocationTable {
+		if int(re.Segnum)-1 != segIdx {
+			relocs = append(relocs, re)
+		}
+	}
+	io.RelocationTable = relocs
+	io.Header.RelocationEntriesNum = uint(len(relocs))
+	g.discarded = append(g.discarded, comdatCopy{io, seg})
+	return false
+}
+
+// redirect mette nella segmentAllocationTable la copia tenuta al posto di
+// quelle scartate
+func (g *comdatGroups) redirect(segmentAllocationTable SegmentAllocationTable) {
+	for _, d := range g.discarded {
+		if segmentAllocationTable[d.seg.Name] == nil {
+			segmentAllocationTable[d.seg.Name] = map[string]*obj.Segment{}
+		}
+		segmentAllocationTable[d.seg.Name][d.io.Filename] = g.kept[d.seg.Group].seg
+	}
+}
+
+// comdatDiscarded dice se il segmento segnum (da 1) di io è una copia scartata
+func comdatDiscarded(segmentAllocationTable SegmentAllocationTable, io *obj.MyObjectFormat, segnum uint) bool {
+	if segnum == 0 || segnum > uint(len(io.SegmentTable)) {
+		return false
+	}
+	seg := io.SegmentTable[segnum-1]
+	return seg.Group != "" && segmentAllocationTable[seg.Name][io.Filename] != seg
+}
+
+// checkComdatSymbol controlla che sym, definito nella copia scartata di un gruppo
+// in io, sia definito anche nella copia tenuta
+func checkComdatSymbol(inputObjs []*obj.MyObjectFormat, segmentAllocationTable SegmentAllocationTable, io *obj.MyObjectFormat, sym *obj.Symbol) error {
+	discarded := io.SegmentTable[sym.Segnum-1]
+	kept := segmentAllocationTable[discarded.Name][io.Filename]
+	for _, other := range inputObjs {
+		keptSegnum := slices.Index(other.SegmentTable, kept) + 1
+		if keptSegnum == 0 {
+			continue
+		}
+		for _, s := range other.SymbolTable {
+			if s.Kind == obj.Defined && !s.Local && s.Segnum == uint(keptSegnum) && symbolKey(s) == symbolKey(sym) {
+				return nil
+			}
+		}
+		return fmt.Errorf("il simbolo %s è definito nella copia del gruppo %s in %s ma non in quella tenuta di %s",
+			symbolKey(sym), discarded.Group, io.Filename, other.Filename)
+	}
+	return fmt.Errorf("il simbolo %s è definito nella copia del gruppo %s in %s ma non trovo quella tenuta",
+		symbolKey(sym), discarded.Group, io.Filename)
+}
@@ -0,0 +1,132 @@
+package linker
+
+import (
+	"fmt"
+	obj "koltrakak/my-linker/objectformat"
+	"strconv"
+	"strings"
+)
+
+/****** SIMBOLI DEFINITI DAL LINKER ******/
+
+// Un simbolo con Segnum 0 è assoluto: il suo valore non dipende da dove finiscono
+// i segmenti e non si sposta nemmeno se il loader sposta l'immagine (tipo gli
+// indirizzi dei registri di una periferica).
+//
+// Oltre a quelli degli input ci sono i simboli definiti da riga di comando con
+// -defsym nome=espressione, dove l'espressione è un numero, un simbolo, oppure un
+// simbolo più o meno un numero (stack_top=_end+0x4000). Il linker fornisce anche
+// _etext e _edata (la fine di .text e .data) e _end, ma solo se nessun input li
+// definisce. _end non è la fine di .bss: dopo .bss ci sono i segmenti custom e
+// quelli del linker (.got, .plt, ...), quindi è la fine del segmento più in alto,
+// così quello che ci metto dopo (heap, stack) non pesta niente.
+//
+// Per i simboli creati dal linker Segnum non è il numero di un segmento di un
+// input: serve solo a dire se il valore è assoluto (0) o si sposta con l'immagine.
+
+const DEFSYM_FILENAME = "-defsym" // al posto del nome del file nella GlobalSymbolTable
+
+type Defsym struct {
+	Name   string
+	Base   string // simbolo a cui è relativo, vuoto se il valore è assoluto
+	Offset int64
+
+	provide bool // lo definisco solo se nessun input lo definisce
+	segnum  uint // per i simboli del linker, 0 se il valore è assoluto
+}
+
+func ParseDefsym(s string) (Defsym, error) {
+	name, expr, found := strings.Cut(s, "=")
+	name = strings.TrimSpace(name)
+	expr = strings.TrimSpace(expr)
+	if !found || name == "" || expr == "" {
+		return Defsym{}, fmt.Errorf("-defsym %s: mi aspettavo nome=espressione", s)
+	}
+	d := Defsym{Name: name}
+
+	// l'eventuale +/- numero sta in fondo. Parto da 1 così un numero negativo
+	// da solo non viene preso per una sottrazione
+	base, offset := expr, ""
+	if i := strings.LastIndexAny(expr[1:], "+-"); i >= 0 {
+		base, offset = strings.TrimSpace(expr[:i+1]), strings.TrimSpace(expr[i+1:])
+	}
+	if n, err := strconv.ParseInt(base, 0, 64); err == nil {
+		d.Offset = n
+	} else {
+		d.Base = base
+	}
+	if offset != "" {
+		n, err := strconv.ParseInt(strings.ReplaceAll(offset, " ", ""), 0, 64)
+		if err != nil {
+			return Defsym{}, fmt.Errorf("-defsym %s: %s non è un numero", s, offset[1:])
+		}
+		d.Offset += n
+	}
+	return d, nil
+}
+
+// boundarySymbols restituisce _etext, _edata e _end dell'output
+func boundarySymbols(outputObj *obj.MyObjectFormat) []Defsym {
+	var res []Defsym
+	for _, b := range []struct{ name, seg string }{{"_etext", ".text"}, {"_edata", ".data"}} {
+		for i, seg := range outputObj.SegmentTable {
+			if seg.Name == b.seg {
+				res = append(res, Defsym{
+					Name:    b.name,
+					Offset:  int64(seg.StartAddress + seg.Length),
+					provide: true,
+					segnum:  uint(i) + 1,
+				})
+			}
+		}
+	}
+
+	end := Defsym{Name: "_end", provide: true}
+	for i, seg := range outputObj.SegmentTable {
+		if segEnd := int64(seg.StartAddress + seg.Length); end.segnum == 0 || segEnd > end.Offset {
+			end.Offset = segEnd
+			end.segnum = uint(i) + 1
+		}
+	}
+	if end.segnum != 0 {
+		res = append(res, end)
+	}
+	return res
+}
+
+// defineSymbols aggiunge alla tabella globale i simboli del linker, nell'ordine
+// dato: un -defsym può usare quelli definiti prima di lui
+func defineSymbols(globalSymbolTable GlobalSymbolTable, defsyms []Defsym) error {
+	for _, d := range defsyms {
+		if prev, ok := globalSymbolTable[d.Name]; ok {
+			if d.provide {
+				continue
+			}
+			return fmt.Errorf("il simbolo %s è stato definito più volte: %s, %s", d.Name, prev.FileName, DEFSYM_FILENAME)
+		}
+
+		value := d.Offset
+		segnum := d.segnum
+		if d.Base != "" {
+			base, ok := globalSymbolTable[d.Base]
+			if !ok || base.Symbol.Kind != obj.Defined {
+				return fmt.Errorf("-defsym %s: il simbolo %s non è definito", d.Name, d.Base)
+			}
+			if base.Dynamic {
+				return fmt.Errorf("-defsym %s: %s sta in una libreria condivisa, il suo indirizzo lo sa solo il loader", d.Name, d.Base)
+			}
+			value += int64(base.Symbol.Value)
+			segnum = base.Symbol.Segnum
+		}
+		if value < 0 || value > 0xffffffff {
+			return fmt.Errorf("-defsym %s: il valore %d non è un indirizzo valido", d.Name, value)
+		}
+
+		fmt.Printf("### defsym %s = %#x\n", d.Name, value)
+		globalSymbolTable[d.Name] = SymbolTableEntry{
+			FileName: DEFSYM_FILENAME,
+			Symbol:   &obj.Symbol{Name: d.Name, Value: uint(value), Segnum: segnum, Kind: obj.Defined},
+		}
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package linker
+
+import (
+	"fmt"
+	obj "koltrakak/my-linker/objectformat"
+)
+
+/****** ENTRY POINT ******/
+
+// simboli di ingresso che cerco, in ordine, se non ne viene indicato uno con -e
+var defaultEntrySymbols = []string{"main", "_start"}
+
+func entryCandidates(opts Options) []string {
+	if opts.Entry != "" {
+		return []string{opts.Entry}
+	}
+	return defaultEntrySymbols
+}
+
+// isExecutableSegment dice se ci può stare del codice da eseguire all'avvio:
+// serve la X, e un overlay non va bene perché all'avvio non è in memoria
+func isExecutableSegment(seg *obj.Segment) bool {
+	return seg.Flags[obj.Present] && seg.Flags[obj.Runnable] && !seg.Flags[obj.Overlay]
+}
+
+// setEntryPoint trova il simbolo di ingresso e scrive il suo indirizzo nell'header
+// dell'output. Le librerie condivise non hanno entry point
+func setEntryPoint(outputObj *obj.MyObjectFormat, globalSymbolTable GlobalSymbolTable, opts Options) error {
+	if outputObj.Header.Type == obj.SharedLibrary {
+		if opts.Entry != "" {
+			return fmt.Errorf("le librerie condivise non hanno un entry point, -e %s non ha senso", opts.Entry)
+		}
+		return nil
+	}
+
+	for _, name := range entryCandidates(opts) {
+		entry, ok := globalSymbolTable[name]
+		if !ok {
+			continue
+		}
+		if entry.Dynamic || entry.Symbol.Kind != obj.Defined {
+			return fmt.Errorf("il simbolo di ingresso %s deve essere definito da uno dei file oggetto", name)
+		}
+		addr := entry.Symbol.Value
+		var containing []string
+		for _, seg := range outputObj.SegmentTable {
+			if addr < seg.StartAddress || addr >= seg.StartAddress+seg.Length {
+				continue
+			}
+			if isExecutableSegment(seg) {
+				outputObj.Header.EntryPoint = addr
+				fmt.Printf("### entry point %s = %#x (%s)\n", name, addr, seg.Name)
+				return nil
+			}
+			containing = append(containing, seg.Name)
+		}
+		if len(containing) == 0 {
+			return fmt.Errorf("il simbolo di ingresso %s (%#x) non sta in nessun segmento", name, addr)
+		}
+		return fmt.Errorf("il simbolo di ingresso %s (%#x) sta in %v, che non è un segmento eseguibile", name, addr, containing)
+	}
+	return fmt.Errorf("nessuno definisce il simbolo di ingresso (cercavo %v)", entryCandidates(opts))
+}
@@ -0,0 +1,200 @@
+package linker
+
+import (
+	"fmt"
+	obj "koltrakak/my-linker/objectformat"
+)
+
+/****** GARBAGE COLLECTION DEI SEGMENTI ******/
+
+// Con -gc-sections tengo solo i segmentini degli input raggiungibili dal simbolo
+// di ingresso e dai simboli tenuti esplicitamente (-keep). Il grafo è fatto dalle
+// relocation: un segmentino che contiene una relocation verso un simbolo
+// raggiunge il segmentino in cui il simbolo è definito. Ha senso soprattutto se
+// il compilatore mette ogni funzione in un segmento suo.
+//
+// I segmentini scartati restano nella tabella dei segmenti del loro input ma con
+// lunghezza zero, così i segnum di simboli e relocation restano validi. Spariscono
+// invece i simboli definiti lì dentro e le loro relocation.
+
+// inputSegment identifica un segmentino: indice dell'input e del segmento (da 0)
+type inputSegment struct {
+	obj int
+	seg int
+}
+
+func gcSections(inputObjs []*obj.MyObjectFormat, opts Options) error {
+	defs := map[string]inputSegment{}
+	for i, io := range inputObjs {
+		for _, sym := range io.SymbolTable {
+			if sym.Kind != obj.Defined || sym.Segnum == 0 || sym.Segnum > uint(len(io.SegmentTable)) {
+				// i simboli assoluti o malformati non tengono in vita niente
+				continue
+			}
+			for _, key := range fileSymbolKeys(io.Filename, sym) {
+				defs[key] = inputSegment{i, int(sym.Segnum) - 1}
+			}
+		}
+	}
+
+	// radici: simbolo di ingresso e simboli da tenere. Una libreria condivisa
+	// esporta tutto, quindi lì ogni definizione è una radice
+	var roots []string
+	if opts.Shared {
+		for key := range defs {
+			roots = append(roots, key)
+		}
+	} else {
+		entry := ""
+		for _, name := range entryCandidates(opts) {
+			if _, ok := defs[name]; ok {
+				entry = name
+				break
+			}
+		}
+		if entry == "" {
+			return fmt.Errorf("con -gc-sections serve un simbolo di ingresso, ma nessuno definisce %v", entryCandidates(opts))
+		}
+		roots = append(roots, entry)
+		// gli stub degli overlay saltano al manager senza relocation
+		if opts.Layout != "" {
+			roots = append(roots, OVERLAY_MANAGER)
+		}
+	}
+	for _, name := range opts.Keep {
+		if _, ok := defs[name]; !ok {
+			return fmt.Errorf("il simbolo %s da tenere non è definito da nessun input", name)
+		}
+		roots = append(roots, name)
+	}
+
+	// visita del grafo a partire dalle radici
+	// le copie di un gruppo COMDAT vivono o muoiono insieme: quale tenere lo
+	// decide allocateStorage, che vuole la prima
+	groups := map[string][]inputSegment{}
+	for i, io := range inputObjs {
+		for j, seg := range io.SegmentTable {
+			if seg.Group != "" {
+				groups[seg.Group] = append(groups[seg.Group], inputSegment{i, j})
+			}
+		}
+	}
+	live := map[inputSegment]bool{}
+	var queue []inputSegment
+	var mark func(s inputSegment)
+	mark = func(s inputSegment) {
+		if live[s] {
+			return
+		}
+		live[s] = true
+		queue = append(queue, s)
+		if group := inputObjs[s.obj].SegmentTable[s.seg].Group; group != "" {
+			for _, other := range groups[group] {
+				mark(other)
+			}
+		}
+	}
+	for _, name := range roots {
+		if s, ok := defs[name]; ok {
+			mark(s)
+		}
+	}
+	// le tabelle di inizializzazione non le usa nessuno con una relocation,
+	// ma il codice di avvio le scorre tutte
+	for i, io := range inputObjs {
+		for j, seg := range io.SegmentTable {
+			if _, ok := initFiniPriority(seg.Name); ok {
+				mark(inputSegment{i, j})
+			}
+		}
+	}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		io := inputObjs[cur.obj]
+		for _, re := range io.RelocationTable {
+			if int(re.Segnum)-1 != cur.seg {
+				continue
+			}
+			if re.Kind.IsSegmentRelative() {
+				// il riferimento è direttamente a un segmentino dello stesso file
+				if re.Ref > 0 && re.Ref <= uint(len(io.SegmentTable)) {
+					mark(inputSegment{cur.obj, int(re.Ref) - 1})
+				}
+				continue
+			}
+			if re.Ref == 0 || re.Ref > uint(len(io.SymbolTable)) {
+				continue
+			}
+			sym := io.SymbolTable[re.Ref-1]
+			if sym.Kind == obj.Defined {
+				if sym.Segnum > 0 && sym.Segnum <= uint(len(io.SegmentTable)) {
+					mark(inputSegment{cur.obj, int(sym.Segnum) - 1})
+				}
+			} else if s, ok := defs[symbolKey(sym)]; ok {
+				// se non lo definisce nessun input è di una libreria condivisa
+				// oppure è un errore, che riporterà resolveSymbols
+				mark(s)
+			}
+		}
+	}
+
+	for i, io := range inputObjs {
+		dropSegments(io, func(seg int) bool { return !live[inputSegment{i, seg}] })
+	}
+	return nil
+}
+
+// dropSegments svuota i segmentini di io per cui dead è vero e toglie i simboli
+// definiti lì dentro e le relocation che stanno lì dentro, rinumerando i riferimenti.
+// Toglie anche i simboli non definiti che nessuna relocation rimasta usa,
+// altrimenti resolveSymbols cercherebbe una definizione che non serve a nessuno
+func dropSegments(io *obj.MyObjectFormat, dead func(seg int) bool) {
+	for i, seg := range io.SegmentTable {
+		if !dead(i) || seg.Length == 0 {
+			continue
+		}
+		fmt.Printf("### gc-sections: scartato %s di %s (%d byte)\n", seg.Name, io.Filename, seg.Length)
+		seg.Length = 0
+		if io.Data[i] != nil {
+			io.Data[i] = obj.SegmentData{}
+		}
+	}
+
+	// i symbolnum partono da 1, come gli indici di used e newRef
+	used := make([]bool, len(io.SymbolTable)+1)
+	for _, re := range io.RelocationTable {
+		if re.Segnum > 0 && dead(int(re.Segnum)-1) {
+			continue
+		}
+		if !re.Kind.IsSegmentRelative() && re.Ref > 0 && re.Ref < uint(len(used)) {
+			used[re.Ref] = true
+		}
+	}
+	newRef := make([]uint, len(io.SymbolTable)+1)
+	var symbols []*obj.Symbol
+	for i, sym := range io.SymbolTable {
+		if sym.Kind == obj.Defined && sym.Segnum > 0 && dead(int(sym.Segnum)-1) {
+			continue
+		}
+		if sym.Kind == obj.Undefined && !used[i+1] {
+			continue
+		}
+		symbols = append(symbols, sym)
+		newRef[i+1] = uint(len(symbols))
+	}
+	var relocs []obj.RelocationEntry
+	for _, re := range io.RelocationTable {
+		if re.Segnum > 0 && dead(int(re.Segnum)-1) {
+			continue
+		}
+		if !re.Kind.IsSegmentRelative() && re.Ref > 0 && re.Ref < uint(len(newRef)) {
+			re.Ref = newRef[re.Ref]
+		}
+		relocs = append(relocs, re)
+	}
+	io.SymbolTable = symbols
+	io.RelocationTable = relocs
+	io.Header.SymbolNum = uint(len(symbols))
+	io.Header.RelocationEntriesNum = uint(len(relocs))
+}
@@ -0,0 +1,48 @@
+package linker
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// bar lo usa solo .text.dead, che non si raggiunge da main
+const testGcMain = `LINK
+4 2 1
+.text 0 8 RP
+.data 0 0 RWP
+.bss 0 0 RW
+.text.dead 0 8 RP
+main 0 1 D
+bar 0 0 U
+0 4 2 R4
+1111111111111111
+2222222222222222
+`
+
+const testGcBar = `LINK
+4 1 0
+.text 0 0 RP
+.data 0 0 RWP
+.bss 0 0 RW
+.text.bar 0 8 RP
+bar 0 4 D
+
+3333333333333333
+`
+
+// un simbolo usato solo da un segmento scartato non deve essere definito
+func TestGcSectionsDropsUnusedReferences(t *testing.T) {
+	mainFile := writeTestFile(t, "a.lk", testGcMain)
+	barFile := writeTestFile(t, "b.lk", testGcBar)
+	output := filepath.Join(t.TempDir(), "out.lk")
+
+	outObj, err := Link([]string{mainFile, barFile}, Options{GCSections: true, Output: output})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, seg := range outObj.SegmentTable {
+		if (seg.Name == ".text.dead" || seg.Name == ".text.bar") && seg.Length != 0 {
+			t.Fatalf("il segmento %s doveva essere scartato, è lungo %d", seg.Name, seg.Length)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package linker
+
+import (
+	"encoding/binary"
+	"fmt"
+	obj "koltrakak/my-linker/objectformat"
+)
+
+/****** GLOBAL OFFSET TABLE ******/
+
+// Le relocation GL4 e GO4 non puntano direttamente al simbolo ma ad uno slot
+// della GOT che contiene il suo indirizzo. In questo modo il codice che accede
+// al simbolo resta position independent, l'unica cosa da sistemare è la GOT.
+
+// GOT_SLOT_SIZE è grande quanto il campo di una relocation A4
+const GOT_SLOT_SIZE = 4
+
+// GlobalOffsetTable tiene traccia di quale slot della GOT spetta a ogni simbolo
+type GlobalOffsetTable struct {
+	Segment *obj.Segment
+	Symbols []string        // nomi dei simboli in ordine di slot
+	Slots   map[string]uint // nome del simbolo -> indice del suo slot
+}
+
+func isGotRelocation(re obj.RelocationEntry) bool {
+	return re.Kind == obj.GotLoad4 || re.Kind == obj.GotOffset4
+}
+
+// newGlobalOffsetTable crea uno slot per ogni simbolo referenziato da una
+// relocation che passa dalla GOT. Gli slot sono assegnati nell'ordine in cui
+// incontro i riferimenti, così il layout è deterministico
+func newGlobalOffsetTable(inputObjs []*obj.MyObjectFormat) *GlobalOffsetTable {
+	got := &GlobalOffsetTable{Slots: map[string]uint{}}
+
+	for _, io := range inputObjs {
+		for _, re := range io.RelocationTable {
+			if !isGotRelocation(re) || re.Ref == 0 || re.Ref > uint(len(io.SymbolTable)) {
+				// le relocation malformate le segnala applyFixups
+				continue
+			}
+			name := fileSymbolKey(io.Filename, io.SymbolTable[re.Ref-1])
+			if _, ok := got.Slots[name]; !ok {
+				got.Slots[name] = uint(len(got.Symbols))
+				got.Symbols = append(got.Symbols, name)
+			}
+		}
+	}
+
+	if len(got.Symbols) == 0 {
+		return nil
+	}
+
+	got.Segment = &obj.Segment{
+		Name:         ".got",
+		StartAddress: 0x0, // la piazza allocateStorage insieme agli altri segmenti
+		Length:       uint(len(got.Symbols)) * GOT_SLOT_SIZE,
+		Flags: map[obj.SegmentFlag]bool{
+			obj.Readable: true,
+			obj.Writable: true,
+			obj.Present:  true,
+		},
+	}
+	return got
+}
+
+func (got *GlobalOffsetTable) slotAddress(name string) (uint, error) {
+	slot, ok := got.Slots[name]
+	if !ok {
+		return 0, fmt.Errorf("il simbolo %s non ha uno slot nella GOT", name)
+	}
+	return got.Segment.StartAddress + slot*GOT_SLOT_SIZE, nil
+}
+
+// fillGot scrive in ogni slot l'indirizzo finale del suo simbolo. Va chiamata
+// dopo resolveSymbols, quando i valori dei simboli sono già stati rilocati
+func fillGot(got *GlobalOffsetTable, globalSymbolTable GlobalSymbolTable, gotData obj.SegmentData) error {
+	for i, name := range got.Symbols {
+		entry, ok := globalSymbolTable[name]
+		if !ok {
+			return fmt.Errorf("impossibile riempire la GOT: il simbolo %s non è stato risolto", name)
+		}
+		if entry.Dynamic || entry.Symbol.Kind != obj.Defined {
+			// l'indirizzo lo sa solo il loader, ci pensa lui
+			binary.BigEndian.PutUint32(gotData[uint(i)*GOT_SLOT_SIZE:], 0)
+			continue
+		}
+		if entry.Symbol.Value > 0xffffffff {
+			return fmt.Errorf("impossibile riempire la GOT: l'indirizzo %#x del simbolo %s non sta in uno slot", entry.Symbol.Value, name)
+		}
+		binary.BigEndian.PutUint32(gotData[uint(i)*GOT_SLOT_SIZE:], uint32(entry.Symbol.Value))
+	}
+	return nil
+}
@@ -0,0 +1,435 @@
+package linker
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	obj "koltrakak/my-linker/objectformat"
+	"maps"
+	"os"
+	"slices"
+)
+
+/****** LINK INCREMENTALE ******/
+
+// Nel link incrementale ogni segmentino ha un po' di spazio libero dopo di sé
+// (slack) e accanto all'output salvo lo stato del link: dove sono finiti i
+// segmentini, quanto spazio libero hanno, la tabella dei simboli globale e i
+// fixup di ogni input che dipendono da simboli definiti in altri file.
+// Al link successivo, se sono cambiati solo alcuni input e i loro segmenti ci
+// stanno ancora nello spazio che avevano, riparso solo quelli, rifaccio solo
+// i loro fixup e patcho l'output esistente. I fixup degli altri input verso
+// simboli che si sono spostati li correggo sommando lo spostamento.
+//
+// Per ora lo faccio solo per gli eseguibili statici: con GOT, PLT, overlay o
+// librerie condivise rifaccio sempre il link completo.
+
+const (
+	INCREMENTAL_SLACK_PERCENT = 25
+	INCREMENTAL_MIN_SLACK     = 64
+	INCREMENTAL_STATE_SUFFIX  = ".inc.json"
+)
+
+// SlackTable ha le stesse chiavi della SegmentAllocationTable: quanto spazio
+// libero c'è dopo ogni segmentino
+type SlackTable map[string]map[string]uint
+
+func segmentSlack(seg *obj.Segment) uint {
+	return align(max(seg.Length*INCREMENTAL_SLACK_PERCENT/100, INCREMENTAL_MIN_SLACK), WORD_SIZE)
+}
+
+// errFullRelink vuol dire che il link incrementale non si può fare e serve
+// quello completo, non è un errore vero e proprio
+var errFullRelink = errors.New("serve il link completo")
+
+type incrementalInput struct {
+	Filename string
+	Hash     string
+}
+
+// externalFixup è un fixup A4 o R4 verso un simbolo definito in un altro file.
+// Loc della relocation è l'indirizzo nell'output
+type externalFixup struct {
+	Reloc  obj.RelocationEntry
+	Symbol string
+}
+
+// incrementalOptions sono le opzioni che cambiano il risultato del link. Le
+// salvo nello stato perché se sono diverse da quelle del link precedente
+// l'output vecchio non vale più, anche se gli input sono gli stessi
+type incrementalOptions struct {
+	Wrap         []string
+	Rename       map[string]string
+	Defsyms      []Defsym
+	GCSections   bool
+	Keep         []string
+	Entry        string
+	SegmentFlags string
+	WX           string
+	Signatures   string
+}
+
+func newIncrementalOptions(opts Options) incrementalOptions {
+	res := incrementalOptions{
+		GCSections:   opts.GCSections,
+		Entry:        opts.Entry,
+		SegmentFlags: cmp.Or(opts.SegmentFlags, DEFAULT_SEGMENT_FLAGS),
+		WX:           cmp.Or(opts.WX, DEFAULT_WX),
+		Signatures:   cmp.Or(opts.Signatures, DEFAULT_SIGNATURES),
+	}
+	// vuoto e nil devono essere uguali, anche dopo essere passati dal json
+	if len(opts.Wrap) > 0 {
+		res.Wrap = opts.Wrap
+	}
+	if len(opts.Rename) > 0 {
+		res.Rename = opts.Rename
+	}
+	if len(opts.Defsyms) > 0 {
+		res.Defsyms = opts.Defsyms
+	}
+	if len(opts.Keep) > 0 {
+		res.Keep = opts.Keep
+	}
+	return res
+}
+
+// sameOptions confronta le opzioni passando dal json, come sono salvate nello stato
+func sameOptions(a, b incrementalOptions) bool {
+	ja, errA := json.Marshal(a)
+	jb, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(ja, jb)
+}
+
+type incrementalState struct {
+	Target                 string
+	Options                incrementalOptions
+	Inputs                 []incrementalInput
+	SegmentAllocationTable SegmentAllocationTable
+	SlackTable             SlackTable
+	GlobalSymbolTable      GlobalSymbolTable
+	ExternalFixups         map[string][]externalFixup // nome del file -> i suoi fixup esterni
+}
+
+func statePath(opts Options) string {
+	return opts.Output + INCREMENTAL_STATE_SUFFIX
+}
+
+func hashFile(filename string) (string, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return "", fmt.Errorf("impossibile leggere %s: %w", filename, err)
+	}
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// recordExternalFixups raccoglie i fixup di io che dipendono da simboli di altri file
+func recordExternalFixups(io *obj.MyObjectFormat, segmentAllocationTable SegmentAllocationTable) []externalFixup {
+	var fixups []externalFixup
+	for _, re := range io.RelocationTable {
+		if re.Kind != obj.Absolute4 && re.Kind != obj.Relative4 {
+			continue
+		}
+		sym := io.SymbolTable[re.Ref-1]
+		if sym.Kind == obj.Defined {
+			// i simboli del file stesso si spostano solo se cambia il file
+			continue
+		}
+		segName := io.SegmentTable[re.Segnum-1].Name
+		re.Loc += segmentAllocationTable[segName][io.Filename].StartAddress
+		fixups = append(fixups, externalFixup{Reloc: re, Symbol: symbolKey(sym)})
+	}
+	return fixups
+}
+
+// saveIncrementalState salva lo stato di un link completo. Se il link non si
+// presta a essere rifatto in modo incrementale cancello lo stato vecchio, così
+// il prossimo link sarà di nuovo completo
+func saveIncrementalState(opts Options,
+	inputObjs []*obj.MyObjectFormat,
+	segmentAllocationTable SegmentAllocationTable,
+	slackTable SlackTable,
+	globalSymbolTable GlobalSymbolTable,
+	supported bool) error {
+
+	if !supported {
+		fmt.Println("### link incrementale non supportato con GOT, PLT, overlay o librerie condivise")
+		if err := os.Remove(statePath(opts)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	state := incrementalState{
+		Target:                 opts.Target,
+		Options:                newIncrementalOptions(opts),
+		SegmentAllocationTable: segmentAllocationTable,
+		SlackTable:             slackTable,
+		GlobalSymbolTable:      globalSymbolTable,
+		ExternalFixups:         map[string][]externalFixup{},
+	}
+	for _, io := range inputObjs {
+		hash, err := hashFile(io.Filename)
+		if err != nil {
+			return err
+		}
+		state.Inputs = append(state.Inputs, incrementalInput{Filename: io.Filename, Hash: hash})
+		state.ExternalFixups[io.Filename] = recordExternalFixups(io, segmentAllocationTable)
+	}
+	return writeIncrementalState(opts, &state)
+}
+
+func writeIncrementalState(opts Options, state *incrementalState) error {
+	content, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(statePath(opts), content, 0644); err != nil {
+		return fmt.Errorf("impossibile salvare lo stato del link incrementale: %w", err)
+	}
+	return nil
+}
+
+// linkIncremental prova a rifare il link patchando l'output precedente.
+// Se non si può restituisce un errore che avvolge errFullRelink
+func linkIncremental(inputFileNames []string, opts Options) (*obj.MyObjectFormat, error) {
+	content, err := os.ReadFile(statePath(opts))
+	if err != nil {
+		return nil, fmt.Errorf("%w: nessuno stato del link precedente", errFullRelink)
+	}
+	var state incrementalState
+	if err := json.Unmarshal(content, &state); err != nil {
+		return nil, fmt.Errorf("%w: stato del link precedente illeggibile: %v", errFullRelink, err)
+	}
+	if state.Target != opts.Target || opts.Shared || opts.BaseRelocs || opts.Layout != "" || opts.GCSections || len(opts.Defsyms) > 0 ||
+		len(opts.Wrap) > 0 || len(opts.Rename) > 0 ||
+		(opts.SegmentFlags != "" && opts.SegmentFlags != DEFAULT_SEGMENT_FLAGS) {
+		return nil, fmt.Errorf("%w: sono cambiate le opzioni", errFullRelink)
+	}
+	if !sameOptions(state.Options, newIncrementalOptions(opts)) {
+		return nil, fmt.Errorf("%w: le opzioni sono diverse da quelle del link precedente", errFullRelink)
+	}
+	if len(state.Inputs) != len(inputFileNames) {
+		return nil, fmt.Errorf("%w: sono cambiati i file di input", errFullRelink)
+	}
+
+	var changedNames []string
+	for i, in := range state.Inputs {
+		if in.Filename != inputFileNames[i] {
+			return nil, fmt.Errorf("%w: sono cambiati i file di input", errFullRelink)
+		}
+		hash, err := hashFile(in.Filename)
+		if err != nil {
+			return nil, err
+		}
+		if hash != in.Hash {
+			changedNames = append(changedNames, in.Filename)
+			state.Inputs[i].Hash = hash
+		}
+	}
+
+	outputObj, err := obj.ParseObjectFile(opts.Output)
+	if err != nil {
+		return nil, fmt.Errorf("%w: output precedente illeggibile: %v", errFullRelink, err)
+	}
+	fmt.Println("### link incrementale, input cambiati:", changedNames)
+	if len(changedNames) == 0 {
+		// il simbolo di ingresso può essere cambiato con -e
+		if err := setEntryPoint(outputObj, state.GlobalSymbolTable, opts); err != nil {
+			return nil, err
+		}
+		return outputObj, nil
+	}
+
+	changed := make([]*obj.MyObjectFormat, len(changedNames))
+	parseErrs := parallelFor(len(changedNames), opts.Jobs, func(i int) error {
+		o, err := obj.ParseObjectFile(changedNames[i])
+		if err != nil {
+			return fmt.Errorf("parsing di %s fallito: %w", changedNames[i], err)
+		}
+		changed[i] = o
+		return nil
+	})
+	if err := errors.Join(parseErrs...); err != nil {
+		return nil, err
+	}
+
+	sat := state.SegmentAllocationTable
+	gst := state.GlobalSymbolTable
+	oldGst := maps.Clone(gst)
+
+	// i segmenti dei file cambiati devono starci nello spazio che avevano
+	for _, io := range changed {
+		if io.Header.Type != obj.Object {
+			return nil, fmt.Errorf("%w: %s non è più un file oggetto", errFullRelink, io.Filename)
+		}
+		for _, re := range io.RelocationTable {
+			// GOT e PLT non ci sono nell'output di un link statico, aggiungerle vuol dire rifare tutto
+			if re.Kind == obj.GotLoad4 || re.Kind == obj.GotOffset4 || re.Kind == obj.PltCall4 {
+				return nil, fmt.Errorf("%w: %s usa GOT o PLT (relocation %s)", errFullRelink, io.Filename, re.Kind)
+			}
+		}
+		for _, seg := range io.SegmentTable {
+			if seg.Group != "" {
+				// quale copia di un gruppo tenere lo decido solo con tutti gli input
+				return nil, fmt.Errorf("%w: %s ha dei gruppi COMDAT", errFullRelink, io.Filename)
+			}
+		}
+		var names []string
+		for segName, files := range sat {
+			if _, ok := files[io.Filename]; ok {
+				names = append(names, segName)
+			}
+		}
+		if len(names) != len(io.SegmentTable) {
+			return nil, fmt.Errorf("%w: sono cambiati i segmenti di %s", errFullRelink, io.Filename)
+		}
+		for _, seg := range io.SegmentTable {
+			old, ok := sat[seg.Name][io.Filename]
+			if !ok {
+				return nil, fmt.Errorf("%w: sono cambiati i segmenti di %s", errFullRelink, io.Filename)
+			}
+			if obj.FormatSegmentFlags(seg.Flags) != obj.FormatSegmentFlags(old.Flags) {
+				// le flag dell'output (e il controllo W^X) dipendono da quelle di tutti gli input
+				return nil, fmt.Errorf("%w: sono cambiate le flag del segmento %s di %s", errFullRelink, seg.Name, io.Filename)
+			}
+			capacity := old.Length + state.SlackTable[seg.Name][io.Filename]
+			if seg.Length > capacity {
+				return nil, fmt.Errorf("%w: il segmento %s di %s non ci sta più (%d byte, spazio %d)",
+					errFullRelink, seg.Name, io.Filename, seg.Length, capacity)
+			}
+			// prima di copiarci i dati nuovi pulisco quelli vecchi. Se cambia la
+			// priorità di una tabella cambia il nome del segmentino e non lo trovo
+			// nella sat, quindi qui l'ordine dei segmentini di .init_array è quello di prima
+			outName := outputSegmentName(seg.Name)
+			outIdx := slices.IndexFunc(outputObj.SegmentTable, func(s *obj.Segment) bool { return s.Name == outName })
+			if outIdx < 0 {
+				return nil, fmt.Errorf("%w: nell'output manca il segmento %s", errFullRelink, outName)
+			}
+			if outputObj.Data[outIdx] != nil {
+				offset := old.StartAddress - outputObj.SegmentTable[outIdx].StartAddress
+				clear(outputObj.Data[outIdx][offset : offset+capacity])
+			}
+			seg.StartAddress = old.StartAddress
+			sat[seg.Name][io.Filename] = seg
+			state.SlackTable[seg.Name][io.Filename] = capacity - seg.Length
+		}
+	}
+
+	// aggiorno la tabella dei simboli con le definizioni dei file cambiati.
+	// Se un file smette di definire un simbolo qualcun altro potrebbe
+	// usarlo, quindi in quel caso rifaccio tutto
+	for _, io := range changed {
+		defined := map[string]*obj.Symbol{}
+		for _, sym := range io.SymbolTable {
+			if sym.Kind != obj.Defined {
+				continue
+			}
+			if sym.Segnum != 0 {
+				segName, ok := inputSegmentName(io, sym.Segnum)
+				if !ok || sat[segName][io.Filename] == nil {
+					return nil, fmt.Errorf("%w: simbolo %s definito in un segmento non valido", errFullRelink, sym.VersionedName())
+				}
+				sym.Value += sat[segName][io.Filename].StartAddress
+			}
+			for _, key := range fileSymbolKeys(io.Filename, sym) {
+				defined[key] = sym
+			}
+		}
+		for key, entry := range gst {
+			if entry.FileName == io.Filename && defined[key] == nil {
+				return nil, fmt.Errorf("%w: %s non definisce più %s", errFullRelink, io.Filename, key)
+			}
+		}
+		for key, sym := range defined {
+			if prev, ok := gst[key]; ok && prev.FileName != io.Filename {
+				return nil, fmt.Errorf("%w: %s ora è definito anche in %s", errFullRelink, key, io.Filename)
+			}
+			if prev, ok := gst[key]; ok && prev.Symbol.Signature != sym.Signature {
+				// i riferimenti degli altri file vanno ricontrollati
+				return nil, fmt.Errorf("%w: è cambiata la firma di %s", errFullRelink, key)
+			}
+			gst[key] = SymbolTableEntry{FileName: io.Filename, Symbol: sym}
+		}
+	}
+	for _, io := range changed {
+		for _, sym := range io.SymbolTable {
+			if sym.Kind == obj.Undefined {
+				if _, ok := gst[symbolKey(sym)]; !ok {
+					return nil, fmt.Errorf("%w: %s usa %s che non è definito", errFullRelink, io.Filename, symbolKey(sym))
+				}
+			}
+		}
+	}
+
+	if err := checkSignatures(changed, gst, opts.Signatures); err != nil {
+		return nil, err
+	}
+
+	// i fixup dei file cambiati li rifaccio da zero, poi ci copio i dati
+	_, err = applyFixups(changed, gst, sat, &syntheticSegments{}, nil, opts.Jobs)
+	if err != nil {
+		return nil, err
+	}
+	writeFixedData(changed, outputObj)
+
+	// ai fixup degli altri file verso simboli che si sono spostati sommo lo spostamento
+	for _, in := range state.Inputs {
+		if slices.Contains(changedNames, in.Filename) {
+			continue
+		}
+		for _, f := range state.ExternalFixups[in.Filename] {
+			delta := int64(gst[f.Symbol].Symbol.Value) - int64(oldGst[f.Symbol].Symbol.Value)
+			if delta == 0 {
+				continue
+			}
+			if err := patchFixup(outputObj, f, delta); err != nil {
+				return nil, fmt.Errorf("relocation %s in %s, simbolo %s: %w", f.Reloc.Kind, in.Filename, f.Symbol, err)
+			}
+		}
+	}
+	for _, io := range changed {
+		state.ExternalFixups[io.Filename] = recordExternalFixups(io, sat)
+	}
+
+	// se il file cambiato definisce il simbolo di ingresso potrebbe essersi spostato
+	if err := setEntryPoint(outputObj, gst, opts); err != nil {
+		return nil, err
+	}
+
+	if err := writeIncrementalState(opts, &state); err != nil {
+		return nil, err
+	}
+	return outputObj, nil
+}
+
+// patchFixup somma delta al campo di un fixup già applicato nell'output
+func patchFixup(outputObj *obj.MyObjectFormat, f externalFixup, delta int64) error {
+	rng, err := relocationRange(f.Reloc)
+	if err != nil {
+		return err
+	}
+	for i, seg := range outputObj.SegmentTable {
+		if f.Reloc.Loc < seg.StartAddress || f.Reloc.Loc+4 > seg.StartAddress+seg.Length || outputObj.Data[i] == nil {
+			continue
+		}
+		field := outputObj.Data[i][f.Reloc.Loc-seg.StartAddress:][:4]
+		raw := binary.BigEndian.Uint32(field)
+		cur := int64(raw)
+		if rng.signed {
+			cur = int64(int32(raw))
+		}
+		val := cur + delta
+		if val < rng.min || val > rng.max {
+			return fmt.Errorf("overflow all'indirizzo %#x: %d + %d = %d non sta in [%d, %d]", f.Reloc.Loc, cur, delta, val, rng.min, rng.max)
+		}
+		binary.BigEndian.PutUint32(field, uint32(val))
+		return nil
+	}
+	return fmt.Errorf("l'indirizzo %#x non sta in nessun segmento dell'output", f.Reloc.Loc)
+}
@@ -0,0 +1,150 @@
+package linker
+
+import (
+	"bytes"
+	obj "koltrakak/my-linker/objectformat"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testMain = `LINK
+3 2 2
+.text 0 16 RP
+.data 0 8 RWP
+.bss 0 0 RW
+main 0 1 D
+bar 0 0 U
+4 1 2 R4
+0 2 2 A4
+11111111111111111111111111111111
+0000000000000000
+`
+
+// stessa lunghezza dei segmenti nelle due versioni, così il layout non cambia
+const testBar = `LINK
+3 1 0
+.text 0 32 RP
+.data 0 4 RWP
+.bss 0 0 RW
+bar 8 1 D
+3333333333333333333333333333333333333333333333333333333333333333
+cccccccc
+`
+
+const testBarMoved = `LINK
+3 1 0
+.text 0 32 RP
+.data 0 4 RWP
+.bss 0 0 RW
+bar 1c 1 D
+4444444444444444444444444444444444444444444444444444444444444444
+dddddddd
+`
+
+func writeTestFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// linkTo fa quello che fa main: link e scrittura dell'output
+func linkTo(t *testing.T, inputs []string, output string) []byte {
+	t.Helper()
+	return linkWith(t, inputs, Options{Incremental: true, Output: output})
+}
+
+func linkWith(t *testing.T, inputs []string, opts Options) []byte {
+	t.Helper()
+	output := opts.Output
+	outObj, err := Link(inputs, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outObj.Filename = output
+	if err := outObj.WriteObjectFile(output); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+// link completo, modifica di un input, link incrementale: deve venire uguale
+// al link completo degli input modificati
+func TestIncrementalRoundTrip(t *testing.T) {
+	mainFile := writeTestFile(t, "main.lk", testMain)
+	barFile := writeTestFile(t, "bar.lk", testBar)
+	output := filepath.Join(t.TempDir(), "out.lk")
+
+	linkTo(t, []string{mainFile, barFile}, output)
+	if _, err := os.Stat(statePath(Options{Output: output})); err != nil {
+		t.Fatalf("il link completo non ha salvato lo stato: %v", err)
+	}
+
+	if err := os.WriteFile(barFile, []byte(testBarMoved), 0644); err != nil {
+		t.Fatal(err)
+	}
+	incremental := linkTo(t, []string{mainFile, barFile}, output)
+
+	full := linkTo(t, []string{mainFile, barFile}, filepath.Join(t.TempDir(), "full.lk"))
+	if !bytes.Equal(incremental, full) {
+		t.Fatalf("link incrementale diverso da quello completo:\n%s\ninvece di\n%s", incremental, full)
+	}
+}
+
+const testWrapBar = `LINK
+3 1 0
+.text 0 8 RP
+.data 0 0 RWP
+.bss 0 0 RW
+__wrap_bar 0 1 D
+5555555555555555
+`
+
+// senza input cambiati ma con opzioni diverse il link va rifatto da zero
+func TestIncrementalOptionsChanged(t *testing.T) {
+	mainFile := writeTestFile(t, "main.lk", testMain)
+	barFile := writeTestFile(t, "bar.lk", testBar)
+	wrapFile := writeTestFile(t, "wrap.lk", testWrapBar)
+	inputs := []string{mainFile, barFile, wrapFile}
+	output := filepath.Join(t.TempDir(), "out.lk")
+
+	wrapped := linkWith(t, inputs, Options{Incremental: true, Output: output, Wrap: []string{"bar"}})
+	again := linkTo(t, inputs, output)
+	full := linkTo(t, inputs, filepath.Join(t.TempDir(), "full.lk"))
+	if bytes.Equal(again, wrapped) || !bytes.Equal(again, full) {
+		t.Fatalf("senza -wrap il link incrementale doveva essere uguale a quello completo:\n%s\ninvece di\n%s", again, full)
+	}
+}
+
+// se un input cambiato inizia a usare la GOT il link incrementale non si può fare
+func TestIncrementalGotFallsBack(t *testing.T) {
+	mainFile := writeTestFile(t, "main.lk", testMain)
+	barFile := writeTestFile(t, "bar.lk", testBar)
+	output := filepath.Join(t.TempDir(), "out.lk")
+
+	linkTo(t, []string{mainFile, barFile}, output)
+
+	gotMain := bytes.Replace([]byte(testMain), []byte("4 1 2 R4"), []byte("4 1 2 GL4"), 1)
+	if err := os.WriteFile(mainFile, gotMain, 0644); err != nil {
+		t.Fatal(err)
+	}
+	linkTo(t, []string{mainFile, barFile}, output)
+
+	outObj, err := obj.ParseObjectFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, seg := range outObj.SegmentTable {
+		if seg.Name == ".got" {
+			return
+		}
+	}
+	t.Fatal("nell'output rifatto da zero manca la GOT")
+}
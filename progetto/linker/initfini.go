@@ -0,0 +1,92 @@
+package linker
+
+import (
+	obj "koltrakak/my-linker/objectformat"
+	"strconv"
+	"strings"
+)
+
+/****** TABELLE DI INIZIALIZZAZIONE ******/
+
+// I costruttori statici (e i distruttori) non li chiama nessuno esplicitamente:
+// il compilatore mette l'indirizzo di ogni funzione in un segmento .init_array
+// (o .fini_array) e il codice di avvio le chiama tutte una dopo l'altra.
+//
+// Il segmento può avere una priorità, .init_array.100: i segmentini di tutti gli
+// input finiscono in un unico segmentone .init_array ordinati per priorità
+// crescente, quelli senza priorità per ultimi. A parità di priorità resta
+// l'ordine della riga di comando.
+//
+// Per scorrere le tabelle il codice di avvio usa i simboli __init_array_start,
+// __init_array_end, __fini_array_start e __fini_array_end. Se un input li
+// definisce vince lui, e se la tabella non c'è valgono entrambi 0 (tabella vuota).
+
+const (
+	INIT_ARRAY = ".init_array"
+	FINI_ARRAY = ".fini_array"
+	// priorità dei segmentini senza suffisso, dopo tutte quelle esplicite
+	DEFAULT_INIT_PRIORITY = 65536
+)
+
+var initFiniArrays = []string{INIT_ARRAY, FINI_ARRAY}
+
+// initFiniSegment è un segmentino di una tabella, da ordinare prima di allocarlo
+type initFiniSegment struct {
+	io       *obj.MyObjectFormat
+	seg      *obj.Segment
+	priority int
+}
+
+// initFiniArray dice a quale tabella appartiene il segmento name e con che priorità
+func initFiniArray(name string) (string, int, bool) {
+	for _, array := range initFiniArrays {
+		suffix, ok := strings.CutPrefix(name, array)
+		if !ok {
+			continue
+		}
+		if suffix == "" {
+			return array, DEFAULT_INIT_PRIORITY, true
+		}
+		// .init_array.foo non è una tabella con priorità, è un segmento qualsiasi
+		if digits, ok := strings.CutPrefix(suffix, "."); ok {
+			if p, err := strconv.Atoi(digits); err == nil && p >= 0 && p < DEFAULT_INIT_PRIORITY {
+				return array, p, true
+			}
+		}
+	}
+	return "", 0, false
+}
+
+func initFiniPriority(name string) (int, bool) {
+	_, priority, ok := initFiniArray(name)
+	return priority, ok
+}
+
+// outputSegmentName restituisce il nome del segmentone in cui finisce il
+// segmentino name: di solito è lo stesso, tranne per le tabelle con priorità
+func outputSegmentName(name string) string {
+	if array, _, ok := initFiniArray(name); ok {
+		return array
+	}
+	return name
+}
+
+// initFiniSymbols restituisce i simboli di inizio e fine delle tabelle
+func initFiniSymbols(outputObj *obj.MyObjectFormat) []Defsym {
+	var res []Defsym
+	for _, array := range initFiniArrays {
+		prefix := "__" + strings.TrimPrefix(array, ".")
+		start := Defsym{Name: prefix + "_start", provide: true}
+		end := Defsym{Name: prefix + "_end", provide: true}
+		for i, seg := range outputObj.SegmentTable {
+			if seg.Name == array {
+				start.Offset = int64(seg.StartAddress)
+				end.Offset = int64(seg.StartAddress + seg.Length)
+				start.segnum = uint(i) + 1
+				end.segnum = uint(i) + 1
+			}
+		}
+		res = append(res, start, end)
+	}
+	return res
+}
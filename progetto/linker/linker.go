@@ -4,8 +4,13 @@ package linker
 import (
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	obj "koltrakak/my-linker/objectformat"
+	"maps"
+	"math"
+	"path/filepath"
+	"slices"
 )
 
 const (
@@ -13,19 +18,90 @@ const (
 	PAGE_SIZE = 4096
 )
 
-func Link(inputFileNames []string) (*obj.MyObjectFormat, error) {
+// Options raccoglie le opzioni da riga di comando che modificano il comportamento del linker
+type Options struct {
+	Jobs   int    // numero massimo di worker per le fasi parallele, <= 0 vuol dire uno per CPU
+	Target string // architettura di cui usare gli stub della PLT, vuoto vuol dire DEFAULT_TARGET
+	Shared bool   // produce una libreria condivisa invece di un eseguibile
+	// l'eseguibile si porta dietro le base relocation in modo che il
+	// loader lo possa caricare a un indirizzo diverso da quello di link
+	BaseRelocs bool
+	Layout     string // file di layout con i gruppi di overlay, vuoto se non ci sono overlay
+	// se l'output precedente c'è e sono cambiati pochi input lo patcho invece
+	// di rifare tutto il link (vedi incremental.go)
+	Incremental bool
+	Output      string // file di output, serve al link incrementale
+	// scarta i segmentini che non si raggiungono dal simbolo di ingresso
+	// né dai simboli in Keep (vedi gc.go)
+	GCSections bool
+	Keep       []string
+	Entry      string   // simbolo da cui parte l'esecuzione, vuoto vuol dire main o _start
+	Defsyms    []Defsym // simboli definiti da riga di comando (vedi defsym.go)
+	// simboli di cui intercettare i riferimenti e simboli da rinominare (vedi rename.go)
+	Wrap   []string
+	Rename map[string]string
+	// come unire le flag di segmentini con lo stesso nome e cosa fare con i
+	// segmenti scrivibili ed eseguibili (vedi segflags.go)
+	SegmentFlags string
+	WX           string
+	Signatures   string // cosa fare se un riferimento ha una firma diversa dalla definizione (vedi signature.go)
+}
+
+func Link(inputFileNames []string, opts Options) (*obj.MyObjectFormat, error) {
+	if opts.Incremental {
+		if opts.Output == "" {
+			return nil, fmt.Errorf("il link incrementale ha bisogno di sapere qual è il file di output")
+		}
+		outputObj, err := linkIncremental(inputFileNames, opts)
+		if !errors.Is(err, errFullRelink) {
+			return outputObj, err
+		}
+		fmt.Println("###", err)
+	}
+
 	// parse input objects
-	var inputObjs []*obj.MyObjectFormat
-	for _, f := range inputFileNames {
-		o, err := obj.ParseObjectFile(f)
+	// I file sono indipendenti e li parso in parallelo. Ogni worker scrive nella
+	// posizione del proprio file, così l'ordine degli input (che decide
+	// l'allocazione dei segmenti e la precedenza dei simboli) resta quello
+	// della riga di comando
+	inputObjs := make([]*obj.MyObjectFormat, len(inputFileNames))
+	parseErrs := parallelFor(len(inputFileNames), opts.Jobs, func(i int) error {
+		o, err := obj.ParseObjectFile(inputFileNames[i])
 		if err != nil {
+			// gli errori del parser non sempre dicono di che file si tratta
+			return fmt.Errorf("parsing di %s fallito: %w", inputFileNames[i], err)
+		}
+		inputObjs[i] = o
+		return nil
+	})
+	// riporto gli errori di tutti i file che non si parsano, non solo del primo
+	if err := errors.Join(parseErrs...); err != nil {
+		return nil, err
+	}
+
+	// le librerie condivise non le copio nell'output, mi servono solo
+	// per risolvere i simboli. Da qui in poi inputObjs sono solo file oggetto
+	inputObjs, sharedLibs, err := splitInputs(inputObjs)
+	if err != nil {
+		return nil, err
+	}
+
+	// -wrap e -rename cambiano i nomi dei simboli, va fatto prima di
+	// qualsiasi cosa li guardi
+	renameSymbols(inputObjs, opts)
+
+	// i segmentini irraggiungibili li tolgo prima di allocare lo spazio
+	if opts.GCSections {
+		if err := gcSections(inputObjs, opts); err != nil {
 			return nil, err
 		}
-		inputObjs = append(inputObjs, o)
 	}
 
 	// allocate storage in output object
-	outputObj, segmentAllocationTable := allocateStorage(inputObjs)
+	outputObj, segmentAllocationTable, slackTable, synth, err := allocateStorage(inputObjs, opts)
+	if err != nil {
+		return nil, err
+	}
 	// pretty print
 	pretty, _ := json.MarshalIndent(outputObj, "", "  ")
 	fmt.Println("### outputObj")
@@ -40,11 +116,10 @@ func Link(inputFileNames []string) (*obj.MyObjectFormat, error) {
 	// spew.Dump(segmentAllocationTable)
 
 	// resolve Symbols
-	segNumSegNameMap := map[uint]string{}
-	for i, s := range outputObj.SegmentTable {
-		segNumSegNameMap[uint(i)+1] = s.Name // nei file oggetto i segnum partono da 1
-	}
-	globalSymbolTable, err := resolveSymbols(inputObjs, segmentAllocationTable, segNumSegNameMap)
+	// in una libreria condivisa i riferimenti non risolti li risolverà il loader
+	defsyms := append(boundarySymbols(outputObj), initFiniSymbols(outputObj)...)
+	defsyms = append(defsyms, opts.Defsyms...)
+	globalSymbolTable, err := resolveSymbols(inputObjs, sharedLibs, segmentAllocationTable, defsyms, opts.Shared, opts.Signatures)
 	if err != nil {
 		return nil, err
 	}
@@ -52,15 +127,128 @@ func Link(inputFileNames []string) (*obj.MyObjectFormat, error) {
 	fmt.Println("### globalSymbolTable")
 	fmt.Println(string(pretty))
 
+	// se produco una libreria condivisa, un eseguibile rilocabile o se linko
+	// contro librerie condivise serve la parte dinamica: symbol table,
+	// relocation per il loader e librerie da caricare.
+	// Un eseguibile rilocabile è come una libreria condivisa che però
+	// preferisce essere caricata all'indirizzo a cui è stato linkato
+	var dyn *dynamicInfo
+	switch {
+	case opts.Shared:
+		outputObj.Header.Type = obj.SharedLibrary
+	case opts.BaseRelocs:
+		outputObj.Header.Type = obj.RelocatableExecutable
+	default:
+		outputObj.Header.Type = obj.Executable
+	}
+	if err := setEntryPoint(outputObj, globalSymbolTable, opts); err != nil {
+		return nil, err
+	}
+	pic := opts.Shared || opts.BaseRelocs
+	if pic || len(sharedLibs) > 0 {
+		dyn, err = newDynamicInfo(inputObjs, globalSymbolTable, outputObj, pic)
+		if err != nil {
+			return nil, err
+		}
+		for _, lib := range sharedLibs {
+			outputObj.Needed = append(outputObj.Needed, filepath.Base(lib.Filename))
+		}
+		outputObj.Header.NeededNum = uint(len(outputObj.Needed))
+	}
+
+	// ora che i simboli hanno il loro valore finale posso riempire GOT e PLT
+	if synth.got != nil {
+		err = fillGot(synth.got, globalSymbolTable, segmentData(outputObj, synth.got.Segment))
+		if err != nil {
+			return nil, err
+		}
+		pretty, _ = json.MarshalIndent(synth.got, "", "  ")
+		fmt.Println("### got")
+		fmt.Println(string(pretty))
+	}
+	if synth.plt != nil {
+		err = fillPlt(synth.plt, globalSymbolTable,
+			segmentData(outputObj, synth.plt.Segment),
+			segmentData(outputObj, synth.plt.GotPltSegment),
+			dyn != nil) // in un link statico nessuno farebbe il lazy binding
+		if err != nil {
+			return nil, err
+		}
+		pretty, _ = json.MarshalIndent(synth.plt, "", "  ")
+		fmt.Println("### plt")
+		fmt.Println(string(pretty))
+	}
+	if synth.ovl != nil {
+		var rootData obj.SegmentData
+		if synth.ovl.RootSegment != nil {
+			rootData = segmentData(outputObj, synth.ovl.RootSegment)
+		}
+		err = fillOverlayTable(synth.ovl, globalSymbolTable, outputObj,
+			segmentData(outputObj, synth.ovl.TableSegment), rootData)
+		if err != nil {
+			return nil, err
+		}
+		pretty, _ = json.MarshalIndent(synth.ovl, "", "  ")
+		fmt.Println("### overlay")
+		fmt.Println(string(pretty))
+	}
+
 	// apply fixups
-	applyFixups(inputObjs, globalSymbolTable, segmentAllocationTable, segNumSegNameMap)
+	runtimeRelocs, err := applyFixups(inputObjs, globalSymbolTable, segmentAllocationTable, synth, dyn, opts.Jobs)
+	if err != nil {
+		return nil, err
+	}
+	if dyn != nil {
+		// anche gli slot di GOT e PLT li deve sistemare il loader
+		if synth.got != nil {
+			gotRelocs, err := gotRuntimeRelocations(dyn, synth.got, globalSymbolTable)
+			if err != nil {
+				return nil, err
+			}
+			runtimeRelocs = append(runtimeRelocs, gotRelocs...)
+		}
+		if synth.plt != nil {
+			pltRelocs, err := pltRuntimeRelocations(dyn, synth.plt, globalSymbolTable)
+			if err != nil {
+				return nil, err
+			}
+			runtimeRelocs = append(runtimeRelocs, pltRelocs...)
+		}
+		outputObj.RelocationTable = runtimeRelocs
+	}
+	outputObj.Header.SymbolNum = uint(len(outputObj.SymbolTable))
+	outputObj.Header.RelocationEntriesNum = uint(len(outputObj.RelocationTable))
 
 	// write fixed data segments
 	writeFixedData(inputObjs, outputObj)
 
+	if opts.Incremental {
+		supported := dyn == nil && synth.got == nil && synth.plt == nil && synth.ovl == nil
+		err = saveIncrementalState(opts, inputObjs, segmentAllocationTable, slackTable, globalSymbolTable, supported)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return outputObj, nil
 }
 
+// splitInputs separa i file oggetto dalle librerie condivise, mantenendo l'ordine
+func splitInputs(inputObjs []*obj.MyObjectFormat) ([]*obj.MyObjectFormat, []*obj.MyObjectFormat, error) {
+	var objects, sharedLibs []*obj.MyObjectFormat
+	for _, io := range inputObjs {
+		switch io.Header.Type {
+		case obj.Object:
+			objects = append(objects, io)
+		case obj.SharedLibrary:
+			sharedLibs = append(sharedLibs, io)
+		default:
+			return nil, nil, fmt.Errorf("%s non è né un file oggetto né una libreria condivisa (tipo %s)", io.Filename, io.Header.Type)
+		}
+	}
+	return objects, sharedLibs, nil
+}
+
 /****** STORAGE ALLOCATION ******/
 
 // In questa tabella salvo le informazioni di allocazione di ogni segmento di ogni input file.
@@ -73,7 +261,58 @@ func align(x uint, alignment uint) uint {
 	return (x + (alignment - 1)) &^ (alignment - 1) // nand mi azzera i LSB
 }
 
-func allocateStorage(inputObjs []*obj.MyObjectFormat) (*obj.MyObjectFormat, SegmentAllocationTable) {
+// syntheticSegments raccoglie i segmenti che non arrivano da nessun input file
+// ma che genera il linker stesso
+type syntheticSegments struct {
+	got *GlobalOffsetTable     // nil se nessuno usa la GOT
+	plt *ProcedureLinkageTable // nil se nessuno chiama tramite PLT
+	ovl *OverlayTable          // nil se non c'è un file di layout
+}
+
+// inputSegmentName restituisce il nome del segmento numero segnum (da 1) di io.
+// I segnum sono dell'input, non dell'output: gli input non devono avere i
+// segmenti nello stesso ordine dell'output
+func inputSegmentName(io *obj.MyObjectFormat, segnum uint) (string, bool) {
+	if segnum == 0 || segnum > uint(len(io.SegmentTable)) {
+		return "", false
+	}
+	return io.SegmentTable[segnum-1].Name, true
+}
+
+// segmentData restituisce i dati del segmento di output seg
+func segmentData(outputObj *obj.MyObjectFormat, seg *obj.Segment) obj.SegmentData {
+	for i, s := range outputObj.SegmentTable {
+		if s == seg {
+			return outputObj.Data[i]
+		}
+	}
+	return nil
+}
+
+func allocateStorage(inputObjs []*obj.MyObjectFormat, opts Options) (*obj.MyObjectFormat, SegmentAllocationTable, SlackTable, *syntheticSegments, error) {
+	pltTarget, err := lookupPltTemplate(opts.Target)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	var layout *OverlayLayout
+	if opts.Layout != "" {
+		if opts.Shared || opts.BaseRelocs {
+			// il manager carica gli overlay agli indirizzi di link, non si possono spostare
+			return nil, nil, nil, nil, fmt.Errorf("gli overlay non si possono usare insieme a -shared o -base-relocs")
+		}
+		layout, err = ParseLayoutFile(opts.Layout)
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+	}
+
+	// text inizia alla seconda pagina dato che la prima è riservata ad header,
+	// le librerie condivise invece partono da 0 e le sposta il loader
+	var textBaseAddress uint = 0x1000
+	if opts.Shared {
+		textBaseAddress = 0
+	}
+
 	// Questa è una struttura dati di appoggio che uso per calcolare
 	// correttamente gli offset dei segmentini con lo stesso nome nei
 	// vari file di input, dentro al segmentone corrispondente nel
@@ -81,6 +320,8 @@ func allocateStorage(inputObjs []*obj.MyObjectFormat) (*obj.MyObjectFormat, Segm
 	// La chiave è il nome del segmento
 	segmentUnificationTable := map[string][]*obj.Segment{}
 	segmentAllocationTable := SegmentAllocationTable{}
+	slackTable := SlackTable{}
+	lastSlack := map[string]uint{} // spazio libero dopo l'ultimo segmentino di ogni segmentone
 
 	outputObj := obj.MyObjectFormat{
 		Header: obj.ObjHeader{},
@@ -88,10 +329,11 @@ func allocateStorage(inputObjs []*obj.MyObjectFormat) (*obj.MyObjectFormat, Segm
 		SegmentTable: []*obj.Segment{
 			{
 				Name:         ".text",
-				StartAddress: 0x1000, // text inizia alla seconda pagina dato che la prima è riservata ad header
+				StartAddress: textBaseAddress,
 				Length:       0,
 				Flags: map[obj.SegmentFlag]bool{
 					obj.Readable: true,
+					obj.Runnable: true,
 					obj.Present:  true,
 				},
 			},
@@ -128,47 +370,122 @@ func allocateStorage(inputObjs []*obj.MyObjectFormat) (*obj.MyObjectFormat, Segm
 		".bss":  outputObj.SegmentTable[2],
 	}
 
-	// scorro tutti i miei input e calcolo le lunghezze dei segmenti
-	for _, io := range inputObjs {
-		for _, seg := range io.SegmentTable { // go fa automaticamente la dereferenziazione quando accedo ai campi di un puntatore
-			// popolo i segmenti del file di output unificando segmenti
-			// con lo stesso nome
-			outputSegPointer, ok := outputSegmentPointerMap[seg.Name]
-			if ok {
-				outputSegPointer.Length += seg.Length
-			} else {
-				seg.StartAddress = 0x0 // lo dovrò rilocare
-				// aggiungo il segmento di tipo ignoto sia alla mappa di supporto
-				// che alla tabella del file di output (siccome è un puntatore le
-				// modifiche come quella di sopra sono visibili ad entrambi)
-				outputSegmentPointerMap[seg.Name] = seg
-				outputObj.SegmentTable = append(outputObj.SegmentTable, seg)
+	// calcolo le lunghezze dei segmenti aggiungendo i segmentini uno alla volta
+	addSegment := func(io *obj.MyObjectFormat, seg *obj.Segment) { // go fa automaticamente la dereferenziazione quando accedo ai campi di un puntatore
+		// popolo i segmenti del file di output unificando segmenti
+		// con lo stesso nome (o che finiscono nello stesso segmentone, vedi initfini.go)
+		outName := outputSegmentName(seg.Name)
+		// nel link incrementale lascio dello spazio libero dopo ogni segmentino,
+		// così se l'input cresce un po' non devo spostare tutti gli altri
+		var slack uint
+		if opts.Incremental {
+			slack = segmentSlack(seg)
+		}
+		outputSegPointer, ok := outputSegmentPointerMap[outName]
+		if !ok {
+			// segmento con un nome non standard (.rodata, .init, ...): il
+			// segmentone lo creo nuovo, con le flag del primo segmentino.
+			// Non posso usare il segmentino stesso, altrimenti il suo
+			// StartAddress sarebbe sia quello del segmentone che l'offset dentro
+			outputSegPointer = &obj.Segment{
+				Name:  outName,
+				Flags: maps.Clone(seg.Flags),
 			}
-			// salvo il mio segmento in modo da non perderlo con l'unificazione
-			var curSegOffset uint
-			numUnifiedCurSegmentType := len(segmentUnificationTable[seg.Name]) // len restituisce 0 se lo slice è nil
-			// Inizialmente, per ogni segmento calcolo solamente l'offset all'interno del suo segmentone.
-			// Sotto faccio la rilocazione per ottenere lo StartAddress finale nel file di output
-			if numUnifiedCurSegmentType > 0 {
-				prev := segmentUnificationTable[seg.Name][numUnifiedCurSegmentType-1] // prendo l'ultimo che ho aggiunto
-				curSegOffset = prev.StartAddress + prev.Length
-			} else {
-				curSegOffset = 0
+			// lo aggiungo sia alla mappa di supporto che alla tabella del file di output
+			outputSegmentPointerMap[outName] = outputSegPointer
+			outputObj.SegmentTable = append(outputObj.SegmentTable, outputSegPointer)
+		}
+		outputSegPointer.Length += seg.Length + slack
+		// salvo il mio segmento in modo da non perderlo con l'unificazione
+		var curSegOffset uint
+		numUnifiedCurSegmentType := len(segmentUnificationTable[outName]) // len restituisce 0 se lo slice è nil
+		// Inizialmente, per ogni segmento calcolo solamente l'offset all'interno del suo segmentone.
+		// Sotto faccio la rilocazione per ottenere lo StartAddress finale nel file di output
+		if numUnifiedCurSegmentType > 0 {
+			prev := segmentUnificationTable[outName][numUnifiedCurSegmentType-1] // prendo l'ultimo che ho aggiunto
+			curSegOffset = prev.StartAddress + prev.Length + lastSlack[outName]
+		} else {
+			curSegOffset = 0
+		}
+		seg.StartAddress = curSegOffset
+		// qua salvo seg per poter calcolare l'offset del prossimo segmento dello stesso tipo
+		segmentUnificationTable[outName] = append(segmentUnificationTable[outName], seg)
+		lastSlack[outName] = slack
+		// qua salvo seg per non perdere le informazioni sui vari segmentini nel file di output finale.
+		// NB: la chiave è il nome del segmentino, che per .init_array.100 non è quello del segmentone
+		_, ok = segmentAllocationTable[seg.Name]
+		if !ok {
+			// alloco la sottomappa che ha come chiave il nome del file se necessario
+			segmentAllocationTable[seg.Name] = make(map[string]*obj.Segment)
+		}
+		segmentAllocationTable[seg.Name][io.Filename] = seg
+		if opts.Incremental {
+			if slackTable[seg.Name] == nil {
+				slackTable[seg.Name] = map[string]uint{}
+			}
+			slackTable[seg.Name][io.Filename] = slack
+		}
+		// HO SALVATO DEI PUNTATORI! Modifiche a segmenti in segmentUnificationTable
+		// saranno visibili anche in segmentAllocationTable
+	}
+
+	// scorro tutti i miei input nell'ordine della riga di comando, tranne le
+	// tabelle di inizializzazione che vanno ordinate per priorità
+	// delle copie di un gruppo COMDAT alloco solo la prima (vedi comdat.go)
+	var arrays []initFiniSegment
+	comdat := newComdatGroups()
+	for _, io := range inputObjs {
+		for i, seg := range io.SegmentTable {
+			if !comdat.keep(io, i) {
+				continue
 			}
-			seg.StartAddress = curSegOffset
-			// qua salvo seg per poter calcolare l'offset del prossimo segmento dello stesso tipo
-			segmentUnificationTable[seg.Name] = append(segmentUnificationTable[seg.Name], seg)
-			// qua salvo seg per non perdere le informazioni sui vari segmentini nel file di output finale
-			_, ok = segmentAllocationTable[seg.Name]
-			if !ok {
-				// alloco la sottomappa che ha come chiave il nome del file se necessario
-				segmentAllocationTable[seg.Name] = make(map[string]*obj.Segment)
+			if priority, ok := initFiniPriority(seg.Name); ok {
+				arrays = append(arrays, initFiniSegment{io, seg, priority})
+				continue
 			}
-			segmentAllocationTable[seg.Name][io.Filename] = seg
-			// HO SALVATO DEI PUNTATORI! Modifiche a segmenti in segmentUnificationTable
-			// saranno visibili anche in segmentAllocationTable
+			addSegment(io, seg)
 		}
 	}
+	// a parità di priorità resta l'ordine degli input
+	slices.SortStableFunc(arrays, func(a, b initFiniSegment) int { return a.priority - b.priority })
+	for _, a := range arrays {
+		addSegment(a.io, a.seg)
+	}
+	comdat.redirect(segmentAllocationTable)
+
+	// i segmentini con lo stesso nome possono non essere d'accordo sulle flag
+	if err := mergeSegmentFlags(inputObjs, &outputObj, opts.SegmentFlags); err != nil {
+		return nil, nil, nil, nil, err
+	}
+	// .text contiene il codice anche se gli input sono di prima che ci fosse la X
+	outputSegmentPointerMap[".text"].Flags[obj.Runnable] = true
+
+	// i segmenti sintetizzati dal linker li metto in coda, dopo quelli degli input
+	synth := &syntheticSegments{}
+	synth.got = newGlobalOffsetTable(inputObjs)
+	if synth.got != nil {
+		outputObj.SegmentTable = append(outputObj.SegmentTable, synth.got.Segment)
+	}
+	synth.plt = newProcedureLinkageTable(inputObjs, pltTarget)
+	if synth.plt != nil {
+		outputObj.SegmentTable = append(outputObj.SegmentTable, synth.plt.Segment, synth.plt.GotPltSegment)
+	}
+	if layout != nil {
+		synth.ovl, err = newOverlayTable(inputObjs, layout, pltTarget)
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		outputObj.SegmentTable = append(outputObj.SegmentTable, synth.ovl.TableSegment)
+		if synth.ovl.RootSegment != nil {
+			outputObj.SegmentTable = append(outputObj.SegmentTable, synth.ovl.RootSegment)
+		}
+		for _, seg := range synth.ovl.Overlays {
+			outputSegmentPointerMap[seg].Flags[obj.Overlay] = true
+		}
+	}
+	if err := checkWriteXorExecute(inputObjs, &outputObj, opts.WX); err != nil {
+		return nil, nil, nil, nil, err
+	}
 
 	// non scordiamoci di aggiornare l'header ora che sappiamo quanti segmenti ha
 	// il file di output
@@ -176,8 +493,38 @@ func allocateStorage(inputObjs []*obj.MyObjectFormat) (*obj.MyObjectFormat, Segm
 	// Aggiusto gli StartAddress
 	// sia dei segmentoni nel file di output,
 	// che dei segmentini nella segmentAllocationTable
+	placeSegment := func(outSeg *obj.Segment, baseAddress uint) {
+		outSeg.StartAddress = baseAddress
+		// aggiungo il baseAddress a tutti i segmentini dentro al segmentone corrente
+		for _, segmentino := range segmentUnificationTable[outSeg.Name] {
+			// NB: qua sto modificando anche la segmentAllocationTable
+			// dato che punta alla stessa struct
+			segmentino.StartAddress += baseAddress
+		}
+	}
 	var prevSeg *obj.Segment = nil
+	placedGroups := map[*OverlayGroup]bool{}
 	for _, outSeg := range outputObj.SegmentTable {
+		// i segmenti di un gruppo di overlay li piazzo tutti insieme quando
+		// incontro il primo: partono tutti dallo stesso indirizzo e il gruppo
+		// occupa quanto il più grande
+		if layout != nil && layout.groupOf[outSeg.Name] != nil {
+			g := layout.groupOf[outSeg.Name]
+			if placedGroups[g] {
+				continue
+			}
+			placedGroups[g] = true
+			g.StartAddress = align(prevSeg.StartAddress+prevSeg.Length, PAGE_SIZE)
+			for _, name := range g.Segments {
+				ovSeg := outputSegmentPointerMap[name]
+				placeSegment(ovSeg, g.StartAddress)
+				g.Length = max(g.Length, ovSeg.Length)
+			}
+			// per il prossimo segmento conta la fine del gruppo
+			prevSeg = &obj.Segment{StartAddress: g.StartAddress, Length: g.Length}
+			continue
+		}
+
 		// "A reasonable allocation strategy would be to put at 1000 the segments with RP attributes,
 		// then starting at the next 1000 boundary RWP attributes, then on a 4 boundary RW attributes."
 		// ...
@@ -191,14 +538,7 @@ func allocateStorage(inputObjs []*obj.MyObjectFormat) (*obj.MyObjectFormat, Segm
 		} else {
 			baseAddress = align(prevSeg.StartAddress+prevSeg.Length, PAGE_SIZE)
 		}
-		outSeg.StartAddress = baseAddress
-
-		// aggiungo il baseAddress a tutti i segmentini dentro al segmentone corrente
-		for _, segmentino := range segmentUnificationTable[outSeg.Name] {
-			// NB: qua sto modificando anche la segmentAllocationTable
-			// dato che punta alla stessa struct
-			segmentino.StartAddress += baseAddress
-		}
+		placeSegment(outSeg, baseAddress)
 		prevSeg = outSeg
 	}
 
@@ -208,10 +548,12 @@ func allocateStorage(inputObjs []*obj.MyObjectFormat) (*obj.MyObjectFormat, Segm
 		if seg.Flags[obj.Present] {
 			outputObj.Data = append(outputObj.Data, make(obj.SegmentData, seg.Length))
 			// i dati ce li copio dopo che ho applicato i fixup
+		} else {
+			outputObj.Data = append(outputObj.Data, nil)
 		}
 	}
 
-	return &outputObj, segmentAllocationTable
+	return &outputObj, segmentAllocationTable, slackTable, synth, nil
 }
 
 /****** SYMBOL RESOLUTION ******/
@@ -219,14 +561,56 @@ func allocateStorage(inputObjs []*obj.MyObjectFormat) (*obj.MyObjectFormat, Segm
 type SymbolTableEntry struct {
 	FileName string
 	Symbol   *obj.Symbol
+	Dynamic  bool // definito in una libreria condivisa, l'indirizzo lo sa solo il loader
 }
 
-// GlobalSymbolTable la chiave è il nome del simbolo
+// GlobalSymbolTable la chiave è il nome del simbolo (vedi symbolKey e fileSymbolKey)
 type GlobalSymbolTable map[string]SymbolTableEntry
 
+// symbolKey è la chiave con cui un simbolo sta nella GlobalSymbolTable: il nome,
+// seguito dalla versione se ce l'ha. Le definizioni della versione di default
+// stanno anche sotto il nome senza versione, così i riferimenti senza versione le trovano
+func symbolKey(sym *obj.Symbol) string {
+	if sym.Version == "" {
+		return sym.Name
+	}
+	return sym.Name + "@" + sym.Version
+}
+
+// symbolKeys restituisce tutte le chiavi sotto cui va registrata una definizione
+func symbolKeys(sym *obj.Symbol) []string {
+	if sym.Version != "" && sym.DefaultVersion {
+		return []string{symbolKey(sym), sym.Name}
+	}
+	return []string{symbolKey(sym)}
+}
+
+// I simboli locali li vede solo il file che li definisce, quindi li metto nella
+// tabella globale sotto una chiave che contiene anche il nome del file: due file
+// possono avere il loro init senza litigare. I riferimenti (U) sono sempre globali
+func fileSymbolKey(filename string, sym *obj.Symbol) string {
+	if sym.Local {
+		return filename + "::" + symbolKey(sym)
+	}
+	return symbolKey(sym)
+}
+
+func fileSymbolKeys(filename string, sym *obj.Symbol) []string {
+	if sym.Local {
+		return []string{fileSymbolKey(filename, sym)}
+	}
+	return symbolKeys(sym)
+}
+
+// Se allowUndefined è vero i riferimenti a simboli che nessuno definisce non sono
+// un errore, finiscono nella tabella globale come simboli non definiti.
+// signaturePolicy dice cosa fare dei riferimenti con la firma sbagliata (vedi signature.go)
 func resolveSymbols(inputObjs []*obj.MyObjectFormat,
+	sharedLibs []*obj.MyObjectFormat,
 	segmentAllocationTable SegmentAllocationTable,
-	segNumSegNameMap map[uint]string) (GlobalSymbolTable, error) {
+	defsyms []Defsym,
+	allowUndefined bool,
+	signaturePolicy string) (GlobalSymbolTable, error) {
 
 	globalSymbolTable := GlobalSymbolTable{}
 	unresolvedReferences := map[string][]SymbolTableEntry{}
@@ -235,33 +619,47 @@ func resolveSymbols(inputObjs []*obj.MyObjectFormat,
 	for _, io := range inputObjs {
 		for _, sym := range io.SymbolTable {
 			if sym.Kind == obj.Defined {
+				if !sym.Local && comdatDiscarded(segmentAllocationTable, io, sym.Segnum) {
+					// lo deve definire già la copia tenuta del gruppo
+					if err := checkComdatSymbol(inputObjs, segmentAllocationTable, io, sym); err != nil {
+						return nil, err
+					}
+					continue
+				}
 				// check if a symbol is defined multiple times
-				_, ok := globalSymbolTable[sym.Name]
-				if ok {
-					return nil, fmt.Errorf("il simbolo %s è stato definito più volte: %s, %s", sym.Name, globalSymbolTable[sym.Name].FileName, io.Filename)
-				} else {
-					// risolvo il valore del simbolo tenendo conto di dove il suo segmento di definizione
-					// (presente in uno dei vari file di input) è stato rilocato nell'output file
-					segName, ok := segNumSegNameMap[sym.Segnum]
+				for _, key := range fileSymbolKeys(io.Filename, sym) {
+					if prev, ok := globalSymbolTable[key]; ok {
+						return nil, fmt.Errorf("il simbolo %s è stato definito più volte: %s, %s", key, prev.FileName, io.Filename)
+					}
+				}
+				// risolvo il valore del simbolo tenendo conto di dove il suo segmento di definizione
+				// (presente in uno dei vari file di input) è stato rilocato nell'output file.
+				// I simboli con segnum 0 sono assoluti e restano come sono
+				if sym.Segnum != 0 {
+					segName, ok := inputSegmentName(io, sym.Segnum)
 					if !ok {
 						return nil, fmt.Errorf("trovato simbolo definito dentro a un segnum non esistente: %v->%d", sym, sym.Segnum)
 					}
 					segBaseAddress := segmentAllocationTable[segName][io.Filename].StartAddress
 					// DEBUG:
-					fmt.Println("symbol:", sym.Name)
+					fmt.Println("symbol:", sym.VersionedName())
 					fmt.Println("	segment-relative value:", sym.Value)
 					fmt.Println("	input segment base address:", segBaseAddress)
 					sym.Value += segBaseAddress
+				}
 
-					// aggiungo il simbolo risolto alla tabella globale
-					globalSymbolTable[sym.Name] = SymbolTableEntry{
+				// aggiungo il simbolo risolto alla tabella globale
+				for _, key := range fileSymbolKeys(io.Filename, sym) {
+					globalSymbolTable[key] = SymbolTableEntry{
 						FileName: io.Filename,
 						Symbol:   sym,
 					}
-					delete(unresolvedReferences, sym.Name)
+					delete(unresolvedReferences, key)
 				}
-			} else {
-				unresolvedReferences[sym.Name] = append(unresolvedReferences[sym.Name], SymbolTableEntry{
+			} else if _, ok := globalSymbolTable[symbolKey(sym)]; !ok {
+				// se il simbolo è già stato definito da un input precedente
+				// il riferimento è già risolto
+				unresolvedReferences[symbolKey(sym)] = append(unresolvedReferences[symbolKey(sym)], SymbolTableEntry{
 					FileName: io.Filename,
 					Symbol:   sym,
 				})
@@ -270,12 +668,62 @@ func resolveSymbols(inputObjs []*obj.MyObjectFormat,
 		}
 	}
 
+	// poi i simboli definiti dal linker (-defsym, _end, ...), che possono
+	// dipendere da quelli degli input
+	if err := defineSymbols(globalSymbolTable, defsyms); err != nil {
+		return nil, err
+	}
+	for _, d := range defsyms {
+		delete(unresolvedReferences, d.Name)
+	}
+
+	// i riferimenti che nessun file oggetto definisce li possono soddisfare le
+	// librerie condivise, nell'ordine in cui compaiono tra gli input. Il codice
+	// della libreria non lo copio, quindi il simbolo lo risolverà il loader
+	// Con le versioni: un riferimento a foo si lega alla versione di default,
+	// uno a foo@V1 proprio alla versione V1
+	for _, lib := range sharedLibs {
+		for _, sym := range lib.SymbolTable {
+			if sym.Kind != obj.Defined || sym.Local {
+				continue
+			}
+			for _, key := range symbolKeys(sym) {
+				if _, ok := unresolvedReferences[key]; !ok {
+					continue
+				}
+				globalSymbolTable[key] = SymbolTableEntry{
+					FileName: lib.Filename,
+					Symbol:   sym,
+					Dynamic:  true,
+				}
+				delete(unresolvedReferences, key)
+			}
+		}
+	}
+
+	// ora che so a cosa è legato ogni riferimento controllo che il tipo sia quello giusto
+	if err := checkSignatures(inputObjs, globalSymbolTable, signaturePolicy); err != nil {
+		return nil, err
+	}
+
+	if allowUndefined {
+		for k, v := range unresolvedReferences {
+			globalSymbolTable[k] = v[0]
+		}
+		return globalSymbolTable, nil
+	}
+
 	// check if there are references with no definition
 	if len(unresolvedReferences) > 0 {
 		errString := ""
 		for k, v := range unresolvedReferences {
 			for _, r := range v {
-				errString += fmt.Sprintf("il simbolo %s all'interno del file %s, non è stato definito\n", k, r.FileName)
+				errString += fmt.Sprintf("il simbolo %s all'interno del file %s, non è stato definito", k, r.FileName)
+				if r.Symbol.Version != "" {
+					// se ho chiesto una versione precisa dico quali ci sono
+					errString += fmt.Sprintf(" (versioni disponibili: %v)", availableVersions(r.Symbol.Name, inputObjs, sharedLibs))
+				}
+				errString += "\n"
 			}
 		}
 		return nil, fmt.Errorf("%s", errString)
@@ -284,86 +732,316 @@ func resolveSymbols(inputObjs []*obj.MyObjectFormat,
 	return globalSymbolTable, nil
 }
 
+// availableVersions elenca le versioni di name definite dagli input
+func availableVersions(name string, inputObjs []*obj.MyObjectFormat, sharedLibs []*obj.MyObjectFormat) []string {
+	var versions []string
+	for _, io := range append(slices.Clone(inputObjs), sharedLibs...) {
+		for _, sym := range io.SymbolTable {
+			if sym.Kind == obj.Defined && sym.Name == name && sym.Version != "" {
+				versions = append(versions, sym.VersionedName())
+			}
+		}
+	}
+	return versions
+}
+
 /****** FIXUP APPLICATION ******/
 
 // per semplificarmi la vita, i segmenti vengono trattati come simboli e sono presenti nella symbol table.
 // "this makes segment relative relocation a special case of symbol relative one"
 
-// TODO: questo è altamente parallelizzabile dato che tutti i fixup sono indipendenti
+// fixupRange è l'intervallo di valori che il campo di una relocation riesce a contenere.
+// Gli indirizzi assoluti sono senza segno, gli spiazzamenti relativi invece possono
+// essere anche negativi
+type fixupRange struct {
+	signed   bool
+	min, max int64
+}
+
+var (
+	unsigned32 = fixupRange{signed: false, min: 0, max: math.MaxUint32}
+	signed32   = fixupRange{signed: true, min: math.MinInt32, max: math.MaxInt32}
+)
+
+func relocationRange(re obj.RelocationEntry) (fixupRange, error) {
+	switch re.Kind {
+	case obj.Absolute4, obj.SegmentAbsolute4:
+		return unsigned32, nil
+	case obj.Relative4, obj.SegmentRelative4, obj.GotLoad4, obj.GotOffset4, obj.PltCall4:
+		return signed32, nil
+	default:
+		return fixupRange{}, fmt.Errorf("trovata relocation entry di tipo non supportato: %s", re.Kind)
+	}
+}
+
+// Tutti i fixup sono indipendenti: ogni input file scrive solo nei propri dati e
+// legge tabelle globali che a questo punto non cambiano più. Li applico quindi in
+// parallelo, un input file per worker.
 func applyFixups(inputObjs []*obj.MyObjectFormat,
 	globalSymbolTable GlobalSymbolTable,
 	segmentAllocationTable SegmentAllocationTable,
-	segNumSegNameMap map[uint]string) (*obj.MyObjectFormat, error) {
+	synth *syntheticSegments,
+	dyn *dynamicInfo,
+	jobs int) ([]obj.RelocationEntry, error) {
 
-	// scorro tutte le relocation entry di tutti gli input file
-	for _, io := range inputObjs {
+	// se sto producendo una libreria condivisa alcuni fixup lasciano
+	// una relocation per il loader, ogni worker raccoglie le sue
+	runtimeRelocsPerObj := make([][]obj.RelocationEntry, len(inputObjs))
+
+	// non mi fermo al primo errore, voglio vedere tutte le relocation sbagliate in un colpo solo
+	errsPerObj := parallelFor(len(inputObjs), jobs, func(i int) error {
+		io := inputObjs[i]
+		var errs []error
 		for _, re := range io.RelocationTable {
-			var relocationValue uint
-			fixupLocationValue := io.Data[re.Segnum-1][re.Loc : re.Loc+4] // devo togliere uno dati che i segnum partono da 1
-			symbolName := io.SymbolTable[re.Ref-1].Name                   // devo togliere uno dato che i symbolnum partono da 1
-			symbol := globalSymbolTable[symbolName].Symbol
-			defined := io.SymbolTable[re.Ref-1].Kind == obj.Defined // devo togliere uno dato che i symbolnum partono da 1
-			segOfSymbol := segNumSegNameMap[symbol.Segnum]
-			// Devo applicare i fixup considerando 3 variabili:
-			// - location della relocation entry e simbolo (defined) con cui la
-			//   risolvo, sono nello stesso segmento?
-			// - tipo della relocation entry (assoluta, relativa, ...)
-			// - il simbolo con cui risolvo la relocation entry è definito o no?
-			// non ho voglia di spiegare come queste informazioni vanno utilizzate
-			// (futuro me non ti arrabbiare)
-			switch re.Kind {
-			case obj.Absolute4:
-				if defined {
-					relocationValue = segmentAllocationTable[segOfSymbol][io.Filename].StartAddress
-				} else {
-					// per simboli non definiti il valore nella location è zero,
-					// sommo quindi il valore finale del simbolo
-					relocationValue = globalSymbolTable[symbolName].Symbol.Value
-				}
+			runtimeReloc, err := applyFixup(io, re, globalSymbolTable, segmentAllocationTable, synth, dyn)
+			if err != nil {
+				errs = append(errs, err)
+			} else if runtimeReloc != nil {
+				runtimeRelocsPerObj[i] = append(runtimeRelocsPerObj[i], *runtimeReloc)
+			}
+		}
+		return errors.Join(errs...)
+	})
 
-			case obj.Relative4:
-				segOfFixup := segNumSegNameMap[re.Segnum]
-				fixupOutBaseAddress := segmentAllocationTable[segOfFixup][io.Filename].StartAddress
-				fixupOutLocation := re.Loc + fixupOutBaseAddress
-
-				if defined {
-					if segOfFixup == segOfSymbol {
-						// non devo fare niente, l'offset continua ad essere corretto
-					} else {
-						symbolOutBaseAddress := segmentAllocationTable[segOfSymbol][io.Filename].StartAddress
-						// aggiungo di quanto si è spostato il mio target,
-						// tolgo di quanto mi sono spostato io
-						relocationValue = symbolOutBaseAddress - fixupOutBaseAddress
-					}
-				} else {
-					// se il riferimento è relativo devo saltare della differenza tra le due posizioni
-					relocationValue = globalSymbolTable[symbolName].Symbol.Value - fixupOutLocation
-				}
+	// l'ordine è quello degli input file, quindi il report è deterministico
+	if err := errors.Join(errsPerObj...); err != nil {
+		return nil, err
+	}
+	var runtimeRelocs []obj.RelocationEntry
+	for _, relocs := range runtimeRelocsPerObj {
+		runtimeRelocs = append(runtimeRelocs, relocs...)
+	}
+	return runtimeRelocs, nil
+}
+
+func applyFixup(io *obj.MyObjectFormat,
+	re obj.RelocationEntry,
+	globalSymbolTable GlobalSymbolTable,
+	segmentAllocationTable SegmentAllocationTable,
+	synth *syntheticSegments,
+	dyn *dynamicInfo) (*obj.RelocationEntry, error) {
+
+	// controllo che la relocation entry punti a roba che esiste prima di
+	// indicizzare qualsiasi cosa
+	if re.Segnum == 0 || re.Segnum > uint(len(io.SegmentTable)) || re.Segnum > uint(len(io.Data)) {
+		return nil, fmt.Errorf("relocation %s in %s all'offset %#x: segnum %d non esistente", re.Kind, io.Filename, re.Loc, re.Segnum)
+	}
+	segName := io.SegmentTable[re.Segnum-1].Name // devo togliere uno dati che i segnum partono da 1
+	// le relocation di segmento (SA4, SR4) in ref hanno il numero di un segmento
+	// dell'input invece che di un simbolo. refName è quello che uso nei messaggi
+	segmentRef := re.Kind.IsSegmentRelative()
+	var symbolName, refName string
+	if segmentRef {
+		if re.Ref == 0 || re.Ref > uint(len(io.SegmentTable)) {
+			return nil, fmt.Errorf("relocation %s in %s, segmento %s, offset %#x: segmento numero %d non esistente", re.Kind, io.Filename, segName, re.Loc, re.Ref)
+		}
+		refName = io.SegmentTable[re.Ref-1].Name
+	} else {
+		if re.Ref == 0 || re.Ref > uint(len(io.SymbolTable)) {
+			return nil, fmt.Errorf("relocation %s in %s, segmento %s, offset %#x: simbolo numero %d non esistente", re.Kind, io.Filename, segName, re.Loc, re.Ref)
+		}
+		symbolName = fileSymbolKey(io.Filename, io.SymbolTable[re.Ref-1]) // devo togliere uno dato che i symbolnum partono da 1
+		refName = symbolName
+	}
+	if re.Loc+4 > uint(len(io.Data[re.Segnum-1])) {
+		return nil, fmt.Errorf("relocation %s in %s, segmento %s, offset %#x, riferimento %s: la location esce dal segmento", re.Kind, io.Filename, segName, re.Loc, refName)
+	}
+
+	rng, err := relocationRange(re)
+	if err != nil {
+		return nil, err
+	}
+
+	var relocationValue int64
+	fixupLocationValue := io.Data[re.Segnum-1][re.Loc : re.Loc+4]
+	var symbolEntry SymbolTableEntry
+	var defined, external, absolute bool
+	var segOfSymbol string
+	if !segmentRef {
+		var ok bool
+		symbolEntry, ok = globalSymbolTable[symbolName]
+		if !ok || symbolEntry.Symbol == nil {
+			return nil, fmt.Errorf("relocation %s in %s, segmento %s, offset %#x: il simbolo %s non è nella tabella globale", re.Kind, io.Filename, segName, re.Loc, refName)
+		}
+		defined = io.SymbolTable[re.Ref-1].Kind == obj.Defined
+		if defined {
+			// definito in questo file, quindi il segnum è di uno dei miei segmenti
+			segOfSymbol, _ = inputSegmentName(io, io.SymbolTable[re.Ref-1].Segnum)
+		}
+		// i simboli esterni sono quelli delle librerie condivise o quelli che
+		// nessuno definisce (possibile solo quando produco una libreria condivisa)
+		external = symbolEntry.Symbol.Kind != obj.Defined || symbolEntry.Dynamic
+		// quelli assoluti non stanno in nessun segmento e non si spostano
+		// con l'immagine
+		absolute = !external && symbolEntry.Symbol.Segnum == 0
+	}
+	symbol := symbolEntry.Symbol
+	segOfFixup := segName
+	fixupOutBaseAddress := int64(segmentAllocationTable[segOfFixup][io.Filename].StartAddress)
+	fixupOutLocation := int64(re.Loc) + fixupOutBaseAddress
+	// se c'è di mezzo il loader alcuni fixup non li posso completare, in
+	// quel caso preparo una relocation per il loader
+	var runtimeReloc *obj.RelocationEntry
+	runtimeSymbol := ""
+	// il valore già presente nella location è l'addendo, che va letto
+	// con o senza segno a seconda del tipo di relocation
+	raw := binary.BigEndian.Uint32(fixupLocationValue)
+	addend := int64(raw)
+	if rng.signed {
+		addend = int64(int32(raw))
+	}
+	// con gli overlay alcuni riferimenti devono passare da uno stub e altri
+	// sono proprio vietati
+	viaStub := false
+	if synth.ovl != nil {
+		if segmentRef {
+			viaStub, err = synth.ovl.checkSegments(segName, refName, refName, re)
+		} else {
+			viaStub, err = synth.ovl.checkReference(segName, symbolName, re)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("relocation %s in %s, segmento %s, offset %#x: %w", re.Kind, io.Filename, segName, re.Loc, err)
+		}
+	}
+	// Devo applicare i fixup considerando 3 variabili:
+	// - location della relocation entry e simbolo (defined) con cui la
+	//   risolvo, sono nello stesso segmento?
+	// - tipo della relocation entry (assoluta, relativa, ...)
+	// - il simbolo con cui risolvo la relocation entry è definito o no?
+	// non ho voglia di spiegare come queste informazioni vanno utilizzate
+	// (futuro me non ti arrabbiare)
+	//
+	// NB: i conti li faccio con interi con segno a 64 bit, altrimenti
+	// le sottrazioni tra indirizzi unsigned fanno wrap silenziosamente
+	switch re.Kind {
+	case obj.Absolute4:
+		if external {
+			// lascio l'addendo com'è, il simbolo lo sommerà il loader
+			runtimeReloc = &obj.RelocationEntry{Kind: obj.Absolute4}
+			runtimeSymbol = symbolName
+		} else if defined && !absolute {
+			relocationValue = int64(segmentAllocationTable[segOfSymbol][io.Filename].StartAddress)
+		} else {
+			// per simboli non definiti (o assoluti) il valore nella location
+			// è zero, sommo quindi il valore finale del simbolo
+			relocationValue = int64(symbol.Value)
+		}
+		if dyn != nil && dyn.pic && !external && !absolute {
+			// l'indirizzo è giusto solo se la libreria viene caricata a 0
+			runtimeReloc = &obj.RelocationEntry{Kind: obj.BaseRelative4}
+		}
 
-			default:
-				return nil, fmt.Errorf("trovata relocation entry di tipo non supportato: %s", re.Kind)
+	case obj.Relative4:
+		if viaStub {
+			// salto allo stub del simbolo nella root, lo stub è lo stesso per
+			// tutti i chiamanti quindi l'addendo non mi serve
+			stubAddress, err := synth.ovl.stubAddress(symbolName)
+			if err != nil {
+				return nil, err
 			}
+			relocationValue = int64(stubAddress) - fixupOutLocation - addend
+		} else if external {
+			runtimeReloc = &obj.RelocationEntry{Kind: obj.Relative4}
+			runtimeSymbol = symbolName
+		} else if absolute && dyn != nil && dyn.pic {
+			// se l'output si sposta la distanza da un indirizzo fisso cambia
+			return nil, fmt.Errorf("relocation %s in %s, segmento %s, offset %#x: %s è assoluto, non ci si può riferire in modo relativo da un output rilocabile",
+				re.Kind, io.Filename, segName, re.Loc, refName)
+		} else if defined && !absolute {
+			if segOfFixup == segOfSymbol {
+				// non devo fare niente, l'offset continua ad essere corretto
+			} else {
+				symbolOutBaseAddress := int64(segmentAllocationTable[segOfSymbol][io.Filename].StartAddress)
+				// aggiungo di quanto si è spostato il mio target,
+				// tolgo di quanto mi sono spostato io
+				relocationValue = symbolOutBaseAddress - fixupOutBaseAddress
+			}
+		} else {
+			// se il riferimento è relativo devo saltare della differenza tra le due posizioni
+			relocationValue = int64(symbol.Value) - fixupOutLocation
+		}
+
+	case obj.SegmentAbsolute4:
+		// come per i simboli definiti la location contiene l'offset dall'inizio
+		// del segmento, ci sommo dove è finito il segmentino nell'output
+		relocationValue = int64(segmentAllocationTable[refName][io.Filename].StartAddress)
+		if dyn != nil && dyn.pic {
+			runtimeReloc = &obj.RelocationEntry{Kind: obj.BaseRelative4}
+		}
+
+	case obj.SegmentRelative4:
+		// aggiungo di quanto si è spostato il segmento target,
+		// tolgo di quanto mi sono spostato io
+		relocationValue = int64(segmentAllocationTable[refName][io.Filename].StartAddress) - fixupOutBaseAddress
+
+	case obj.GotLoad4, obj.GotOffset4:
+		// qua non mi interessa dove sta il simbolo ma dove sta il suo slot
+		// nella GOT, che contiene già il valore finale del simbolo
+		slotAddress, err := synth.got.slotAddress(symbolName)
+		if err != nil {
+			return nil, err
+		}
+		if re.Kind == obj.GotLoad4 {
+			relocationValue = int64(slotAddress) - fixupOutLocation
+		} else {
+			relocationValue = int64(slotAddress) - int64(synth.got.Segment.StartAddress)
+		}
 
-			fmt.Println("### fixup applied")
-			val := binary.BigEndian.Uint32(fixupLocationValue)
-			fmt.Printf("%x + %x\n", fixupLocationValue, relocationValue)
-			val += uint32(relocationValue)
-			binary.BigEndian.PutUint32(fixupLocationValue, val)
-			fmt.Printf("%x\n", fixupLocationValue)
+	case obj.PltCall4:
+		// salto relativo allo stub del simbolo invece che al simbolo stesso
+		entryAddress, err := synth.plt.entryAddress(symbolName)
+		if err != nil {
+			return nil, err
 		}
+		relocationValue = int64(entryAddress) - fixupOutLocation
 	}
 
+	val := addend + relocationValue
+	if val < rng.min || val > rng.max {
+		return nil, fmt.Errorf("overflow nella relocation %s in %s, segmento %s, offset %#x, riferimento %s: %d + %d = %d non sta in [%d, %d]",
+			re.Kind, io.Filename, segName, re.Loc, refName, addend, relocationValue, val, rng.min, rng.max)
+	}
+
+	// una sola Printf, altrimenti le righe dei vari worker si mescolano
+	before := fmt.Sprintf("%x", fixupLocationValue)
+	binary.BigEndian.PutUint32(fixupLocationValue, uint32(val))
+	fmt.Printf("### fixup applied\n%s + %x\n%x\n", before, relocationValue, fixupLocationValue)
+
+	if runtimeReloc != nil {
+		r, err := dyn.runtimeRelocation(*runtimeReloc, uint(fixupOutLocation), outputSegmentName(segOfFixup), runtimeSymbol)
+		if err != nil {
+			return nil, err
+		}
+		return &r, nil
+	}
 	return nil, nil
 }
 
+// writeFixedData copia i dati (ormai fixati) dei segmentini degli input dentro
+// ai segmentoni di output, ognuno al proprio offset
 func writeFixedData(inputObjs []*obj.MyObjectFormat, outputObj *obj.MyObjectFormat) {
+	outputSegmentIndexMap := map[string]int{}
+	for i, seg := range outputObj.SegmentTable {
+		outputSegmentIndexMap[seg.Name] = i
+	}
+
 	for _, io := range inputObjs {
-		// FIXME: qua sto assumendo che l'ordine dei segmenti sia lo stesso
-		// sia tra gli inputfile che nell'outputfile. Questo non necessariamente
-		// è vero. Un approccio migliore sarebbe stato usare una mappa anche per
-		// i segmenti dati
+		// NB: non posso assumere che l'ordine dei segmenti sia lo stesso
+		// tra gli input file e l'output file, cerco il segmentone per nome
 		for i, dataSeg := range io.Data {
-			outputObj.Data[i] = append(outputObj.Data[i], dataSeg...)
+			if len(dataSeg) == 0 {
+				continue
+			}
+			seg := io.SegmentTable[i]
+			outIdx := outputSegmentIndexMap[outputSegmentName(seg.Name)]
+			if !outputObj.SegmentTable[outIdx].Flags[obj.Present] {
+				// non dovrebbe succedere: se un segmentino ha dei dati
+				// mergeSegmentFlags o tiene la P o fa fallire il link
+				fmt.Printf("### %s di %s non è presente nell'output, scarto i suoi dati\n", seg.Name, io.Filename)
+				continue
+			}
+			offset := seg.StartAddress - outputObj.SegmentTable[outIdx].StartAddress
+			copy(outputObj.Data[outIdx][offset:], dataSeg[:min(uint(len(dataSeg)), seg.Length)])
 		}
 	}
 }
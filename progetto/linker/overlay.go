@@ -0,0 +1,299 @@
+package linker
+
+import (
+	"bufio"
+	"fmt"
+	obj "koltrakak/my-linker/objectformat"
+	"os"
+	"slices"
+	"strings"
+)
+
+/****** OVERLAY ******/
+
+// Quando il codice non ci sta tutto in memoria, alcuni segmenti possono condividere
+// lo stesso intervallo di indirizzi: sono gli overlay. Un gruppo di overlay è un
+// insieme di segmenti che si alternano nella stessa zona di memoria, e in ogni
+// momento ne è residente al massimo uno per gruppo. Tutto quello che non sta in un
+// overlay è la root, che resta sempre in memoria.
+//
+// I gruppi li descrive un file di layout, una riga per gruppo:
+//
+//	# commento
+//	overlay <gruppo> <segmento> <segmento> ...
+//
+// Ogni segmento elencato è un overlay (con i segmentini dei vari input unificati
+// come al solito). Il linker ci aggiunge:
+// - .ovtab, la tabella degli overlay: numero di overlay e di gruppi, poi per ogni
+//   overlay una entry (segnum, indirizzo, lunghezza, indirizzo della parola del
+//   gruppo) e infine per ogni gruppo una parola con la entry dell'overlay residente
+//   (OVERLAY_NONE all'inizio)
+// - .ovroot, il segmento root degli stub: le chiamate R4 dentro ad un overlay da
+//   fuori passano da uno stub che spinge sullo stack la entry dell'overlay e
+//   l'indirizzo della funzione, poi salta all'overlay manager (OVERLAY_MANAGER, che
+//   deve definire uno degli input nella root). Il manager carica l'overlay se non è
+//   già residente e salta alla funzione.
+//
+// Un riferimento da fuori che non sia una chiamata R4 invece è vietato, così come
+// qualsiasi riferimento tra due overlay dello stesso gruppo: non possono mai essere
+// residenti insieme.
+
+const (
+	OVERLAY_MANAGER    = "__ovly_manager"
+	OVERLAY_ENTRY_SIZE = 16
+	OVERLAY_WORD_SIZE  = 4
+	OVERLAY_NONE       = 0xffffffff
+)
+
+// i segmenti che il linker unifica o genera da sé non possono stare in un overlay
+var overlayReservedSegments = []string{".text", ".data", ".bss", ".got", ".plt", ".got.plt", ".ovtab", ".ovroot"}
+
+type OverlayGroup struct {
+	Name         string
+	Segments     []string // un overlay per segmento
+	StartAddress uint
+	Length       uint // la lunghezza dell'overlay più grande
+}
+
+type OverlayLayout struct {
+	Groups  []*OverlayGroup
+	groupOf map[string]*OverlayGroup // nome del segmento -> il suo gruppo
+}
+
+func ParseLayoutFile(filename string) (*OverlayLayout, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("impossibile aprire il file di layout %s: %w", filename, err)
+	}
+	defer f.Close()
+
+	layout := &OverlayLayout{groupOf: map[string]*OverlayGroup{}}
+	groupNames := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if fields[0] != "overlay" || len(fields) < 3 {
+			return nil, fmt.Errorf("%s:%d: mi aspettavo 'overlay <gruppo> <segmento> ...', trovato: %s", filename, lineNum, line)
+		}
+		g := &OverlayGroup{Name: fields[1], Segments: fields[2:]}
+		if groupNames[g.Name] {
+			return nil, fmt.Errorf("%s:%d: il gruppo di overlay %s è definito più volte", filename, lineNum, g.Name)
+		}
+		groupNames[g.Name] = true
+		for _, seg := range g.Segments {
+			if slices.Contains(overlayReservedSegments, seg) {
+				return nil, fmt.Errorf("%s:%d: il segmento %s non può stare in un overlay", filename, lineNum, seg)
+			}
+			if prev, ok := layout.groupOf[seg]; ok {
+				return nil, fmt.Errorf("%s:%d: il segmento %s è già nel gruppo di overlay %s", filename, lineNum, seg, prev.Name)
+			}
+			layout.groupOf[seg] = g
+		}
+		layout.Groups = append(layout.Groups, g)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("errore durante la lettura del file di layout %s: %w", filename, err)
+	}
+	return layout, nil
+}
+
+// OverlayTable tiene traccia della tabella degli overlay e degli stub nella root
+type OverlayTable struct {
+	Layout       *OverlayLayout
+	TableSegment *obj.Segment    // .ovtab
+	RootSegment  *obj.Segment    // .ovroot, nil se nessuno chiama dentro un overlay
+	Overlays     []string        // segmenti overlay in ordine di entry
+	Entries      map[string]uint // segmento -> indice della sua entry
+	Stubs        []string        // simboli chiamati tramite stub, in ordine di stub
+	StubEntries  map[string]uint // simbolo -> indice del suo stub
+
+	symbolSegment map[string]string // simbolo -> segmento in cui è definito
+	template      *pltTemplate
+}
+
+// newOverlayTable prepara la tabella e uno stub per ogni funzione di un overlay
+// chiamata da fuori, nell'ordine in cui incontro le chiamate
+func newOverlayTable(inputObjs []*obj.MyObjectFormat, layout *OverlayLayout, template *pltTemplate) (*OverlayTable, error) {
+	t := &OverlayTable{
+		Layout:        layout,
+		Entries:       map[string]uint{},
+		StubEntries:   map[string]uint{},
+		symbolSegment: map[string]string{},
+		template:      template,
+	}
+
+	// mi serve sapere in che segmento sta ogni simbolo prima dell'allocazione,
+	// per capire quali chiamate entrano in un overlay
+	inputSegments := map[string]bool{}
+	for _, io := range inputObjs {
+		for _, seg := range io.SegmentTable {
+			inputSegments[seg.Name] = true
+		}
+		for _, sym := range io.SymbolTable {
+			if sym.Kind != obj.Defined || sym.Segnum == 0 || sym.Segnum > uint(len(io.SegmentTable)) {
+				continue
+			}
+			for _, key := range fileSymbolKeys(io.Filename, sym) {
+				t.symbolSegment[key] = io.SegmentTable[sym.Segnum-1].Name
+			}
+		}
+	}
+
+	for _, g := range layout.Groups {
+		for _, seg := range g.Segments {
+			if !inputSegments[seg] {
+				return nil, fmt.Errorf("il segmento %s del gruppo di overlay %s non compare in nessun input", seg, g.Name)
+			}
+			t.Entries[seg] = uint(len(t.Overlays))
+			t.Overlays = append(t.Overlays, seg)
+		}
+	}
+
+	for _, io := range inputObjs {
+		for _, re := range io.RelocationTable {
+			if re.Kind != obj.Relative4 || re.Segnum == 0 || re.Segnum > uint(len(io.SegmentTable)) ||
+				re.Ref == 0 || re.Ref > uint(len(io.SymbolTable)) {
+				// le relocation malformate le segnala applyFixups
+				continue
+			}
+			name := fileSymbolKey(io.Filename, io.SymbolTable[re.Ref-1])
+			viaStub, err := t.checkReference(io.SegmentTable[re.Segnum-1].Name, name, re)
+			if err != nil || !viaStub {
+				// anche le chiamate vietate le segnala applyFixups, con tutto il contesto
+				continue
+			}
+			if _, ok := t.StubEntries[name]; !ok {
+				t.StubEntries[name] = uint(len(t.Stubs))
+				t.Stubs = append(t.Stubs, name)
+			}
+		}
+	}
+
+	t.TableSegment = &obj.Segment{
+		Name:         ".ovtab",
+		StartAddress: 0x0,
+		Length:       2*OVERLAY_WORD_SIZE + uint(len(t.Overlays))*OVERLAY_ENTRY_SIZE + uint(len(layout.Groups))*OVERLAY_WORD_SIZE,
+		Flags: map[obj.SegmentFlag]bool{
+			obj.Readable: true,
+			obj.Writable: true, // il manager ci segna quale overlay è residente
+			obj.Present:  true,
+		},
+	}
+	if len(t.Stubs) > 0 {
+		t.RootSegment = &obj.Segment{
+			Name:         ".ovroot",
+			StartAddress: 0x0,
+			Length:       uint(len(t.Stubs) * len(template.ovlStub)),
+			Flags: map[obj.SegmentFlag]bool{
+				obj.Readable: true,
+				obj.Runnable: true,
+				obj.Present:  true,
+			},
+		}
+	}
+	return t, nil
+}
+
+// checkReference controlla se dal segmento from si può fare riferimento al simbolo
+// name con la relocation re. Restituisce vero se il riferimento deve passare
+// dallo stub del simbolo
+func (t *OverlayTable) checkReference(from string, name string, re obj.RelocationEntry) (bool, error) {
+	to, ok := t.symbolSegment[name]
+	if !ok {
+		return false, nil
+	}
+	return t.checkSegments(from, to, name, re)
+}
+
+// checkSegments è checkReference quando so già in che segmento (to) sta la
+// cosa a cui faccio riferimento (name, un simbolo o il segmento stesso)
+func (t *OverlayTable) checkSegments(from string, to string, name string, re obj.RelocationEntry) (bool, error) {
+	if to == from {
+		return false, nil
+	}
+	toGroup := t.Layout.groupOf[to]
+	if toGroup == nil {
+		// la root è sempre residente
+		return false, nil
+	}
+	if t.Layout.groupOf[from] == toGroup {
+		return false, fmt.Errorf("%s e %s sono overlay dello stesso gruppo %s, non possono essere residenti insieme", from, to, toGroup.Name)
+	}
+	if re.Kind != obj.Relative4 {
+		return false, fmt.Errorf("riferimento diretto a %s nell'overlay %s: da fuori si può entrare in un overlay solo con una chiamata R4", name, to)
+	}
+	return true, nil
+}
+
+func (t *OverlayTable) entryAddress(seg string) uint {
+	return t.TableSegment.StartAddress + 2*OVERLAY_WORD_SIZE + t.Entries[seg]*OVERLAY_ENTRY_SIZE
+}
+
+func (t *OverlayTable) groupWordAddress(g *OverlayGroup) uint {
+	i := slices.Index(t.Layout.Groups, g)
+	return t.TableSegment.StartAddress + 2*OVERLAY_WORD_SIZE + uint(len(t.Overlays))*OVERLAY_ENTRY_SIZE + uint(i)*OVERLAY_WORD_SIZE
+}
+
+func (t *OverlayTable) stubAddress(name string) (uint, error) {
+	i, ok := t.StubEntries[name]
+	if !ok {
+		return 0, fmt.Errorf("il simbolo %s non ha uno stub nella root degli overlay", name)
+	}
+	return t.RootSegment.StartAddress + i*uint(len(t.template.ovlStub)), nil
+}
+
+// fillOverlayTable scrive la tabella degli overlay e il codice degli stub, ora
+// che gli indirizzi sono quelli finali
+func fillOverlayTable(t *OverlayTable,
+	globalSymbolTable GlobalSymbolTable,
+	outputObj *obj.MyObjectFormat,
+	tableData obj.SegmentData,
+	rootData obj.SegmentData) error {
+
+	order := t.template.order
+	order.PutUint32(tableData[0:], uint32(len(t.Overlays)))
+	order.PutUint32(tableData[OVERLAY_WORD_SIZE:], uint32(len(t.Layout.Groups)))
+	for _, segName := range t.Overlays {
+		segnum := slices.IndexFunc(outputObj.SegmentTable, func(s *obj.Segment) bool { return s.Name == segName }) + 1
+		seg := outputObj.SegmentTable[segnum-1]
+		entry := tableData[t.entryAddress(segName)-t.TableSegment.StartAddress:]
+		order.PutUint32(entry[0:], uint32(segnum))
+		order.PutUint32(entry[4:], uint32(seg.StartAddress))
+		order.PutUint32(entry[8:], uint32(seg.Length))
+		order.PutUint32(entry[12:], uint32(t.groupWordAddress(t.Layout.groupOf[segName])))
+	}
+	for _, g := range t.Layout.Groups {
+		order.PutUint32(tableData[t.groupWordAddress(g)-t.TableSegment.StartAddress:], OVERLAY_NONE)
+	}
+
+	if t.RootSegment == nil {
+		return nil
+	}
+	manager, ok := globalSymbolTable[OVERLAY_MANAGER]
+	if !ok || manager.Dynamic || manager.Symbol.Kind != obj.Defined {
+		return fmt.Errorf("ci sono chiamate dentro agli overlay ma nessuno definisce l'overlay manager %s", OVERLAY_MANAGER)
+	}
+	if seg := t.symbolSegment[OVERLAY_MANAGER]; t.Layout.groupOf[seg] != nil {
+		return fmt.Errorf("l'overlay manager %s deve stare nella root, non nell'overlay %s", OVERLAY_MANAGER, seg)
+	}
+
+	stubLen := uint(len(t.template.ovlStub))
+	for i, name := range t.Stubs {
+		stubAddress, err := t.stubAddress(name)
+		if err != nil {
+			return err
+		}
+		stub := rootData[uint(i)*stubLen : uint(i+1)*stubLen]
+		copy(stub, t.template.ovlStub)
+		order.PutUint32(stub[t.template.ovlStubEntry:], uint32(t.entryAddress(t.symbolSegment[name])))
+		order.PutUint32(stub[t.template.ovlStubTarget:], uint32(globalSymbolTable[name].Symbol.Value))
+		// il salto relativo è rispetto all'indirizzo dell'istruzione successiva
+		nextInstruction := int64(stubAddress) + int64(t.template.ovlStubManager) + 4
+		order.PutUint32(stub[t.template.ovlStubManager:], uint32(int32(int64(manager.Symbol.Value)-nextInstruction)))
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package linker
+
+import (
+	"runtime"
+	"sync"
+)
+
+// numJobs restituisce quante goroutine usare al massimo, se l'utente non ha
+// specificato nulla ne uso una per CPU
+func numJobs(jobs int) int {
+	if jobs <= 0 {
+		return runtime.NumCPU()
+	}
+	return jobs
+}
+
+// parallelFor chiama fn(i) per ogni i in [0, n) con un pool di al massimo jobs worker.
+// Gli errori sono restituiti indicizzati come gli input, in questo modo chi li
+// riporta lo fa sempre nello stesso ordine indipendentemente dallo scheduling
+func parallelFor(n int, jobs int, fn func(i int) error) []error {
+	errs := make([]error, n)
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+
+	for range min(numJobs(jobs), n) {
+		wg.Go(func() {
+			for i := range indexes {
+				errs[i] = fn(i)
+			}
+		})
+	}
+	for i := range n {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	return errs
+}
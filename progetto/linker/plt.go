@@ -0,0 +1,215 @@
+package linker
+
+import (
+	"encoding/binary"
+	"fmt"
+	obj "koltrakak/my-linker/objectformat"
+)
+
+/****** PROCEDURE LINKAGE TABLE ******/
+
+// Le chiamate P4 non saltano direttamente alla funzione ma ad uno stub nella .plt.
+// Lo stub fa un salto indiretto passando dal suo slot nella .got.plt:
+// - se lo slot contiene già l'indirizzo della funzione si arriva subito a destinazione
+// - altrimenti (lazy binding) lo slot punta all'istruzione successiva dello stub, che
+//   spinge sullo stack l'indice della entry e salta a PLT0. PLT0 chiama il resolver
+//   del dynamic linker (il cui indirizzo è in .got.plt[2]) che sistema lo slot.
+//
+// I primi tre slot della .got.plt sono riservati al dynamic linker:
+// [0] informazioni dinamiche del modulo, [1] identificativo del modulo, [2] resolver.
+
+const (
+	GOT_PLT_SLOT_SIZE     = 4
+	GOT_PLT_RESERVED_SLOT = 3
+	DEFAULT_TARGET        = "link32"
+)
+
+// pltTemplate descrive come sono fatti gli stub di un'architettura. I campi *Off
+// sono gli offset, dentro al template, dei campi da 4 byte che il linker deve riempire
+type pltTemplate struct {
+	order binary.ByteOrder
+
+	// PLT0: push GOT[1]; jmp *GOT[2]
+	header         []byte
+	headerGotPlus4 int // indirizzo assoluto di .got.plt[1]
+	headerGotPlus8 int // indirizzo assoluto di .got.plt[2]
+
+	// PLTn: jmp *GOT[n+3]; push n; jmp PLT0
+	entry         []byte
+	entryGotSlot  int // indirizzo assoluto dello slot dell'entry nella .got.plt
+	entryIndex    int // indice dell'entry, lo usa il resolver
+	entryPlt0     int // spiazzamento relativo di PLT0 rispetto alla fine dell'entry
+	entryLazyPush int // offset della push, dove salta lo slot finché non è risolto
+
+	// stub degli overlay: push entry; push target; jmp manager (vedi overlay.go)
+	ovlStub        []byte
+	ovlStubEntry   int // indirizzo assoluto della entry dell'overlay nella tabella
+	ovlStubTarget  int // indirizzo assoluto della funzione chiamata
+	ovlStubManager int // spiazzamento relativo dell'overlay manager rispetto alla fine del salto
+}
+
+// Gli stub sono quelli del PLT non PIC di i386. link32 è la nostra architettura
+// immaginaria: stessi opcode ma big endian come il resto dei fixup del linker
+var pltTemplates = map[string]*pltTemplate{
+	"link32": {
+		order:          binary.BigEndian,
+		header:         []byte{0xff, 0x35, 0, 0, 0, 0, 0xff, 0x25, 0, 0, 0, 0, 0, 0, 0, 0},
+		headerGotPlus4: 2,
+		headerGotPlus8: 8,
+		entry:          []byte{0xff, 0x25, 0, 0, 0, 0, 0x68, 0, 0, 0, 0, 0xe9, 0, 0, 0, 0},
+		entryGotSlot:   2,
+		entryIndex:     7,
+		entryPlt0:      12,
+		entryLazyPush:  6,
+		ovlStub:        []byte{0x68, 0, 0, 0, 0, 0x68, 0, 0, 0, 0, 0xe9, 0, 0, 0, 0, 0x90},
+		ovlStubEntry:   1,
+		ovlStubTarget:  6,
+		ovlStubManager: 11,
+	},
+	"i386": {
+		order:          binary.LittleEndian,
+		header:         []byte{0xff, 0x35, 0, 0, 0, 0, 0xff, 0x25, 0, 0, 0, 0, 0, 0, 0, 0},
+		headerGotPlus4: 2,
+		headerGotPlus8: 8,
+		entry:          []byte{0xff, 0x25, 0, 0, 0, 0, 0x68, 0, 0, 0, 0, 0xe9, 0, 0, 0, 0},
+		entryGotSlot:   2,
+		entryIndex:     7,
+		entryPlt0:      12,
+		entryLazyPush:  6,
+		ovlStub:        []byte{0x68, 0, 0, 0, 0, 0x68, 0, 0, 0, 0, 0xe9, 0, 0, 0, 0, 0x90},
+		ovlStubEntry:   1,
+		ovlStubTarget:  6,
+		ovlStubManager: 11,
+	},
+}
+
+func lookupPltTemplate(target string) (*pltTemplate, error) {
+	if target == "" {
+		target = DEFAULT_TARGET
+	}
+	t, ok := pltTemplates[target]
+	if !ok {
+		return nil, fmt.Errorf("target %s non supportato", target)
+	}
+	return t, nil
+}
+
+// ProcedureLinkageTable tiene traccia di quale stub spetta a ogni funzione chiamata tramite PLT
+type ProcedureLinkageTable struct {
+	Segment       *obj.Segment    // .plt
+	GotPltSegment *obj.Segment    // .got.plt
+	Symbols       []string        // nomi dei simboli in ordine di entry
+	Entries       map[string]uint // nome del simbolo -> indice della sua entry
+
+	template *pltTemplate
+}
+
+// newProcedureLinkageTable crea una entry per ogni simbolo chiamato con una
+// relocation P4, nell'ordine in cui incontro le chiamate
+func newProcedureLinkageTable(inputObjs []*obj.MyObjectFormat, template *pltTemplate) *ProcedureLinkageTable {
+	plt := &ProcedureLinkageTable{Entries: map[string]uint{}, template: template}
+
+	for _, io := range inputObjs {
+		for _, re := range io.RelocationTable {
+			if re.Kind != obj.PltCall4 || re.Ref == 0 || re.Ref > uint(len(io.SymbolTable)) {
+				// le relocation malformate le segnala applyFixups
+				continue
+			}
+			name := fileSymbolKey(io.Filename, io.SymbolTable[re.Ref-1])
+			if _, ok := plt.Entries[name]; !ok {
+				plt.Entries[name] = uint(len(plt.Symbols))
+				plt.Symbols = append(plt.Symbols, name)
+			}
+		}
+	}
+
+	if len(plt.Symbols) == 0 {
+		return nil
+	}
+
+	n := uint(len(plt.Symbols))
+	plt.Segment = &obj.Segment{
+		Name:         ".plt",
+		StartAddress: 0x0,
+		Length:       uint(len(template.header)) + n*uint(len(template.entry)),
+		Flags: map[obj.SegmentFlag]bool{
+			obj.Readable: true,
+			obj.Runnable: true,
+			obj.Present:  true,
+		},
+	}
+	plt.GotPltSegment = &obj.Segment{
+		Name:         ".got.plt",
+		StartAddress: 0x0,
+		Length:       (GOT_PLT_RESERVED_SLOT + n) * GOT_PLT_SLOT_SIZE,
+		Flags: map[obj.SegmentFlag]bool{
+			obj.Readable: true,
+			obj.Writable: true,
+			obj.Present:  true,
+		},
+	}
+	return plt
+}
+
+func (plt *ProcedureLinkageTable) entryAddress(name string) (uint, error) {
+	i, ok := plt.Entries[name]
+	if !ok {
+		return 0, fmt.Errorf("il simbolo %s non ha una entry nella PLT", name)
+	}
+	return plt.Segment.StartAddress + uint(len(plt.template.header)) + i*uint(len(plt.template.entry)), nil
+}
+
+func (plt *ProcedureLinkageTable) gotPltSlotAddress(i uint) uint {
+	return plt.GotPltSegment.StartAddress + (GOT_PLT_RESERVED_SLOT+i)*GOT_PLT_SLOT_SIZE
+}
+
+// fillPlt genera il codice degli stub e il contenuto iniziale della .got.plt.
+// In un link statico non c'è nessun resolver che possa fare lazy binding, quindi
+// gli slot contengono direttamente l'indirizzo della funzione. Se lazy è vero
+// invece gli slot puntano alla push del proprio stub e ci pensa il dynamic linker
+func fillPlt(plt *ProcedureLinkageTable,
+	globalSymbolTable GlobalSymbolTable,
+	pltData obj.SegmentData,
+	gotPltData obj.SegmentData,
+	lazy bool) error {
+
+	t := plt.template
+	order := t.order
+	gotPltBase := uint32(plt.GotPltSegment.StartAddress)
+	plt0 := plt.Segment.StartAddress
+
+	copy(pltData, t.header)
+	order.PutUint32(pltData[t.headerGotPlus4:], gotPltBase+GOT_PLT_SLOT_SIZE)
+	order.PutUint32(pltData[t.headerGotPlus8:], gotPltBase+2*GOT_PLT_SLOT_SIZE)
+
+	for i, name := range plt.Symbols {
+		entryAddress, err := plt.entryAddress(name)
+		if err != nil {
+			return err
+		}
+		entry := pltData[entryAddress-plt0 : entryAddress-plt0+uint(len(t.entry))]
+		copy(entry, t.entry)
+		order.PutUint32(entry[t.entryGotSlot:], uint32(plt.gotPltSlotAddress(uint(i))))
+		order.PutUint32(entry[t.entryIndex:], uint32(i))
+		// il salto relativo è rispetto all'indirizzo dell'istruzione successiva
+		nextInstruction := int64(entryAddress) + int64(t.entryPlt0) + 4
+		order.PutUint32(entry[t.entryPlt0:], uint32(int32(int64(plt0)-nextInstruction)))
+
+		symEntry, ok := globalSymbolTable[name]
+		if !ok {
+			return fmt.Errorf("impossibile riempire la .got.plt: il simbolo %s non è stato risolto", name)
+		}
+		var slotValue uint
+		if lazy && !symEntry.Symbol.Local {
+			slotValue = entryAddress + uint(t.entryLazyPush)
+		} else {
+			// le funzioni locali non le risolve il dynamic linker, lo slot lo lego subito
+			slotValue = symEntry.Symbol.Value
+		}
+		if slotValue > 0xffffffff {
+			return fmt.Errorf("impossibile riempire la .got.plt: l'indirizzo %#x di %s non sta in uno slot", slotValue, name)
+		}
+		order.PutUint32(gotPltData[(GOT_PLT_RESERVED_SLOT+uint(i))*GOT_PLT_SLOT_SIZE:], uint32(slotValue))
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package linker
+
+import (
+	"fmt"
+	obj "koltrakak/my-linker/objectformat"
+	"strings"
+)
+
+/****** WRAP E RENAME DEI SIMBOLI ******/
+
+// Con -wrap sym i riferimenti (non le definizioni) a sym diventano riferimenti
+// a __wrap_sym, e quelli a __real_sym tornano a sym. Così si può mettere
+// qualcosa davanti a malloc senza toccare i file oggetto: __wrap_malloc fa
+// quello che deve e chiama __real_malloc.
+//
+// Con -rename old=new il simbolo globale old si chiama new ovunque, sia dove è
+// definito che dove è usato. I rename vengono applicati prima dei wrap, quindi
+// si può fare il wrap di un simbolo col suo nome nuovo.
+//
+// I nomi li cambio direttamente nelle symbol table degli input, prima della
+// garbage collection dei segmenti, così da lì in poi (risoluzione dei simboli,
+// fixup, symbol table dinamica) nessuno deve sapere che c'è stato un cambio.
+// I simboli locali non li tocco: non li vede nessuno fuori dal loro file.
+
+const (
+	WRAP_PREFIX = "__wrap_"
+	REAL_PREFIX = "__real_"
+)
+
+// ParseRename legge un -rename old=new
+func ParseRename(s string) (string, string, error) {
+	old, newName, found := strings.Cut(s, "=")
+	old = strings.TrimSpace(old)
+	newName = strings.TrimSpace(newName)
+	if !found || old == "" || newName == "" {
+		return "", "", fmt.Errorf("-rename %s: mi aspettavo vecchio=nuovo", s)
+	}
+	if old == newName {
+		return "", "", fmt.Errorf("-rename %s: il nome nuovo è uguale a quello vecchio", s)
+	}
+	return old, newName, nil
+}
+
+func renameSymbols(inputObjs []*obj.MyObjectFormat, opts Options) {
+	if len(opts.Rename) == 0 && len(opts.Wrap) == 0 {
+		return
+	}
+	wrap := map[string]bool{}
+	for _, name := range opts.Wrap {
+		wrap[name] = true
+	}
+
+	for _, io := range inputObjs {
+		for _, sym := range io.SymbolTable {
+			if sym.Local {
+				continue
+			}
+			name := sym.Name
+			if newName, ok := opts.Rename[name]; ok {
+				name = newName
+			}
+			if sym.Kind != obj.Defined {
+				if wrap[name] {
+					name = WRAP_PREFIX + name
+				} else if realName, ok := strings.CutPrefix(name, REAL_PREFIX); ok && wrap[realName] {
+					name = realName
+				}
+			}
+			if name != sym.Name {
+				fmt.Printf("### %s in %s: %s -> %s\n", sym.Kind, io.Filename, sym.Name, name)
+				sym.Name = name
+			}
+		}
+	}
+}
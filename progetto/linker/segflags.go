@@ -0,0 +1,195 @@
+package linker
+
+import (
+	"fmt"
+	obj "koltrakak/my-linker/objectformat"
+	"strings"
+)
+
+/****** FLAG DEI SEGMENTI ******/
+
+// I segmentini con lo stesso nome finiscono nello stesso segmentone, ma non è
+// detto che abbiano le stesse flag: magari un modulo ha .data RW (non presente
+// nel file) e un altro RWP. Le flag del segmentone le decide la politica scelta
+// con -segment-flags:
+// - union: il segmentone ha tutte le flag di tutti i segmentini. È la scelta
+//   sicura, se anche solo un modulo scrive nel segmento deve essere scrivibile
+//   e se un modulo ha dei dati da caricare deve essere presente
+// - intersection: il segmentone ha solo le flag che hanno tutti i segmentini.
+//   Se così perde la P ma qualche segmentino ha dei dati il link fallisce
+// - error: se i segmentini non sono d'accordo il link fallisce
+// In ogni caso stampo quali file hanno quali flag.
+//
+// Le flag di .text, .data e .bss sono fisse solo se nessun input ha quel
+// segmento, altrimenti valgono quelle degli input come per gli altri.
+
+const (
+	SEGMENT_FLAGS_UNION        = "union"
+	SEGMENT_FLAGS_INTERSECTION = "intersection"
+	SEGMENT_FLAGS_ERROR        = "error"
+	DEFAULT_SEGMENT_FLAGS      = SEGMENT_FLAGS_UNION
+)
+
+func checkSegmentFlagsPolicy(policy string) error {
+	switch policy {
+	case SEGMENT_FLAGS_UNION, SEGMENT_FLAGS_INTERSECTION, SEGMENT_FLAGS_ERROR:
+		return nil
+	default:
+		return fmt.Errorf("politica per le flag dei segmenti %q sconosciuta, quelle possibili sono %s, %s e %s",
+			policy, SEGMENT_FLAGS_UNION, SEGMENT_FLAGS_INTERSECTION, SEGMENT_FLAGS_ERROR)
+	}
+}
+
+// mergeSegmentFlags decide le flag dei segmenti di output a partire da quelle
+// dei segmentini degli input
+func mergeSegmentFlags(inputObjs []*obj.MyObjectFormat, outputObj *obj.MyObjectFormat, policy string) error {
+	if policy == "" {
+		policy = DEFAULT_SEGMENT_FLAGS
+	}
+	if err := checkSegmentFlagsPolicy(policy); err != nil {
+		return err
+	}
+
+	for _, outSeg := range outputObj.SegmentTable {
+		// gli input li scorro in ordine, così il report è deterministico
+		var files []string
+		var flags []map[obj.SegmentFlag]bool
+		for _, io := range inputObjs {
+			// i segmentini vuoti (o scartati da -gc-sections) non contano
+			for _, seg := range segmentsOf(io, outSeg) {
+				files = append(files, io.Filename)
+				flags = append(flags, seg.Flags)
+			}
+		}
+		if len(files) == 0 {
+			continue
+		}
+
+		merged := map[obj.SegmentFlag]bool{}
+		for f := range flags[0] {
+			merged[f] = true
+		}
+		// file raggruppati per flag, nell'ordine in cui le incontro
+		var groups []string
+		filesByFlags := map[string][]string{}
+		for i, fl := range flags {
+			s := obj.FormatSegmentFlags(fl)
+			if _, ok := filesByFlags[s]; !ok {
+				groups = append(groups, s)
+			}
+			filesByFlags[s] = append(filesByFlags[s], files[i])
+
+			for f := range fl {
+				if policy == SEGMENT_FLAGS_UNION {
+					merged[f] = true
+				}
+			}
+			for f := range merged {
+				if policy == SEGMENT_FLAGS_INTERSECTION && !fl[f] {
+					delete(merged, f)
+				}
+			}
+		}
+
+		if len(groups) > 1 {
+			report := make([]string, len(groups))
+			for i, g := range groups {
+				report[i] = fmt.Sprintf("%s (%s)", g, strings.Join(filesByFlags[g], ", "))
+			}
+			if policy == SEGMENT_FLAGS_ERROR {
+				return fmt.Errorf("le flag del segmento %s non sono uguali in tutti gli input: %s", outSeg.Name, strings.Join(report, ", "))
+			}
+			fmt.Printf("### flag del segmento %s in conflitto: %s -> %s (%s)\n",
+				outSeg.Name, strings.Join(report, ", "), obj.FormatSegmentFlags(merged), policy)
+		}
+
+		if !merged[obj.Present] {
+			// se il segmentone non è nel file i dati inizializzati degli input si
+			// perderebbero, meglio fallire
+			var withData []string
+			for i, fl := range flags {
+				if fl[obj.Present] {
+					withData = append(withData, files[i])
+				}
+			}
+			if len(withData) > 0 {
+				return fmt.Errorf("con -segment-flags %s il segmento %s non è presente nell'output, ma ha dei dati in: %s",
+					policy, outSeg.Name, strings.Join(withData, ", "))
+			}
+		}
+
+		outSeg.Flags = merged
+	}
+	return nil
+}
+
+// Un segmento sia scrivibile che eseguibile permette di scriversi il codice da
+// eseguire, quindi per le immagini W^X non ci deve essere. Con -wx error il link
+// fallisce, con -wx warn lo segnalo e basta. Il controllo lo faccio alla fine,
+// dopo che le flag sono state unite e ci sono anche i segmenti del linker.
+
+const (
+	WX_ERROR   = "error"
+	WX_WARN    = "warn"
+	DEFAULT_WX = WX_WARN
+)
+
+// checkWriteXorExecute cerca i segmenti scrivibili ed eseguibili dell'output e
+// dice da quali input arrivano la W e la X
+func checkWriteXorExecute(inputObjs []*obj.MyObjectFormat, outputObj *obj.MyObjectFormat, policy string) error {
+	if policy == "" {
+		policy = DEFAULT_WX
+	}
+	if policy != WX_ERROR && policy != WX_WARN {
+		return fmt.Errorf("politica W^X %q sconosciuta, quelle possibili sono %s e %s", policy, WX_ERROR, WX_WARN)
+	}
+
+	var errs []string
+	for _, outSeg := range outputObj.SegmentTable {
+		if !outSeg.Flags[obj.Writable] || !outSeg.Flags[obj.Runnable] {
+			continue
+		}
+		var writers, executors []string
+		for _, io := range inputObjs {
+			for _, seg := range segmentsOf(io, outSeg) {
+				if seg.Flags[obj.Writable] {
+					writers = append(writers, io.Filename)
+				}
+				if seg.Flags[obj.Runnable] {
+					executors = append(executors, io.Filename)
+				}
+			}
+		}
+		msg := fmt.Sprintf("il segmento %s è sia scrivibile che eseguibile (W da: %s; X da: %s)",
+			outSeg.Name, sourcesOrLinker(writers), sourcesOrLinker(executors))
+		if policy == WX_ERROR {
+			errs = append(errs, msg)
+		} else {
+			fmt.Println("### attenzione:", msg)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// se nessun input ha la flag ce l'ha messa il linker (es. la X di .text)
+func sourcesOrLinker(files []string) string {
+	if len(files) == 0 {
+		return "linker"
+	}
+	return strings.Join(files, ", ")
+}
+
+// segmentsOf restituisce i segmentini non vuoti di io che finiscono in outSeg.
+// Possono essere più di uno (.init_array.100 e .init_array.200)
+func segmentsOf(io *obj.MyObjectFormat, outSeg *obj.Segment) []*obj.Segment {
+	var res []*obj.Segment
+	for _, seg := range io.SegmentTable {
+		if seg.Length > 0 && outputSegmentName(seg.Name) == outSeg.Name {
+			res = append(res, seg)
+		}
+	}
+	return res
+}
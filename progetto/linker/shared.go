@@ -0,0 +1,197 @@
+package linker
+
+import (
+	"encoding/binary"
+	"fmt"
+	obj "koltrakak/my-linker/objectformat"
+)
+
+/****** SHARED LIBRARY ******/
+
+// Una libreria condivisa è linkata come se partisse da 0 e non si sa dove
+// verrà caricata. Gli indirizzi assoluti quindi non possono essere sistemati
+// del tutto da applyFixups: per ognuno lascio una relocation al loader.
+// - B4: riferimento assoluto a qualcosa definito nella libreria, il loader
+//   somma di quanto ha spostato la libreria rispetto a dove è stata linkata
+// - A4/R4: riferimento a un simbolo che la libreria non definisce, il loader
+//   lo cerca tra i moduli caricati
+// - J4: slot della .got.plt da legare alla funzione (subito o lazy)
+// I simboli definiti sono esportati nella symbol table del file di output,
+// insieme a quelli non definiti che servono alle relocation.
+//
+// Un eseguibile linkato contro librerie condivise invece sta al suo posto,
+// gli servono solo le relocation che si riferiscono ai simboli delle librerie.
+// Se però è linkato con le base relocation (BaseRelocs) si comporta come una
+// libreria che preferisce essere caricata all'indirizzo a cui è stata linkata.
+
+// dynamicInfo è quello che serve per scrivere symbol table e relocation dinamiche
+type dynamicInfo struct {
+	outputObj   *obj.MyObjectFormat
+	symbolIndex map[string]uint // nome -> numero del simbolo nella symbol table di output (da 1)
+	segIndex    map[string]uint // nome del segmento di output -> segnum (da 1)
+	pic         bool            // l'output può essere caricato ovunque (libreria condivisa o eseguibile rilocabile)
+}
+
+// newDynamicInfo costruisce la symbol table dinamica del file di output. I
+// simboli sono nell'ordine in cui compaiono negli input, così l'output è deterministico
+func newDynamicInfo(inputObjs []*obj.MyObjectFormat, globalSymbolTable GlobalSymbolTable, outputObj *obj.MyObjectFormat, pic bool) (*dynamicInfo, error) {
+	dyn := &dynamicInfo{
+		outputObj:   outputObj,
+		symbolIndex: map[string]uint{},
+		segIndex:    map[string]uint{},
+		pic:         pic,
+	}
+	for i, seg := range outputObj.SegmentTable {
+		dyn.segIndex[seg.Name] = uint(i) + 1
+	}
+
+	for _, io := range inputObjs {
+		for _, sym := range io.SymbolTable {
+			if sym.Local {
+				// i simboli locali non li vede nessun altro modulo
+				continue
+			}
+			key := symbolKey(sym)
+			if _, ok := dyn.symbolIndex[key]; ok {
+				continue
+			}
+			entry := globalSymbolTable[key]
+			external := entry.Dynamic || entry.Symbol.Kind != obj.Defined
+			if !external && entry.FileName != io.Filename {
+				// lo esporto quando arrivo al file che lo definisce
+				continue
+			}
+
+			// i simboli esterni li deve cercare il loader, nella versione
+			// a cui si sono legati adesso (se la libreria ha le versioni)
+			dynSym := &obj.Symbol{Name: sym.Name, Kind: obj.Undefined, Version: entry.Symbol.Version, Signature: sym.Signature}
+			keys := []string{key}
+			if !external {
+				dynSym.Kind = obj.Defined
+				dynSym.DefaultVersion = entry.Symbol.DefaultVersion
+				dynSym.Signature = entry.Symbol.Signature
+				keys = symbolKeys(entry.Symbol)
+				if sym.Segnum > uint(len(io.SegmentTable)) {
+					return nil, fmt.Errorf("il simbolo %s di %s è definito dentro a un segnum non esistente: %d", sym.Name, io.Filename, sym.Segnum)
+				}
+				dynSym.Value = entry.Symbol.Value // già rilocato da resolveSymbols
+				if sym.Segnum != 0 {
+					// i simboli assoluti restano con segnum 0, il loader non li sposta
+					dynSym.Segnum = dyn.segIndex[io.SegmentTable[sym.Segnum-1].Name]
+				}
+			}
+			outputObj.SymbolTable = append(outputObj.SymbolTable, dynSym)
+			for _, k := range keys {
+				dyn.symbolIndex[k] = uint(len(outputObj.SymbolTable))
+			}
+		}
+	}
+
+	return dyn, nil
+}
+
+// runtimeRelocation completa la relocation per il loader re (di cui il chiamante
+// ha scelto solo il tipo) in modo che agisca sull'indirizzo di output address.
+// symbolName è vuoto per le relocation che non usano simboli (B4)
+func (dyn *dynamicInfo) runtimeRelocation(re obj.RelocationEntry, address uint, segName string, symbolName string) (obj.RelocationEntry, error) {
+	segnum, ok := dyn.segIndex[segName]
+	if !ok {
+		return obj.RelocationEntry{}, fmt.Errorf("il segmento %s non esiste nel file di output", segName)
+	}
+	re.Loc = address - dyn.outputObj.SegmentTable[segnum-1].StartAddress
+	re.Segnum = segnum
+	if symbolName != "" {
+		ref, ok := dyn.symbolIndex[symbolName]
+		if !ok {
+			return obj.RelocationEntry{}, fmt.Errorf("il simbolo %s non è nella symbol table dinamica", symbolName)
+		}
+		re.Ref = ref
+	}
+	return re, nil
+}
+
+// gotRuntimeRelocations restituisce le relocation per il loader degli slot della GOT:
+// gli slot dei simboli definiti contengono già l'indirizzo (a partire da 0 se l'output
+// è una libreria condivisa), gli altri li riempie il loader con l'indirizzo del simbolo
+func gotRuntimeRelocations(dyn *dynamicInfo, got *GlobalOffsetTable, globalSymbolTable GlobalSymbolTable) ([]obj.RelocationEntry, error) {
+	var res []obj.RelocationEntry
+	for i, name := range got.Symbols {
+		slotAddress := got.Segment.StartAddress + uint(i)*GOT_SLOT_SIZE
+
+		entry := globalSymbolTable[name]
+		re := obj.RelocationEntry{Kind: obj.BaseRelative4}
+		symbolName := ""
+		if entry.Dynamic || entry.Symbol.Kind != obj.Defined {
+			re.Kind = obj.Absolute4
+			symbolName = name
+		} else if !dyn.pic || entry.Symbol.Segnum == 0 {
+			// l'eseguibile non si sposta (o il simbolo è assoluto), lo slot è già giusto
+			continue
+		}
+		re, err := dyn.runtimeRelocation(re, slotAddress, got.Segment.Name, symbolName)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// pltRuntimeRelocations restituisce le relocation per il loader di PLT e .got.plt.
+// Gli stub contengono indirizzi assoluti della .got.plt e gli slot puntano
+// alla push del loro stub, quindi vanno tutti spostati dell'indirizzo base.
+// In più ogni slot ha una J4 che dice al loader a che funzione legarlo, tranne
+// quelli delle funzioni locali che non sono nella symbol table dinamica: lì lo
+// slot contiene già l'indirizzo della funzione e basta spostarlo
+func pltRuntimeRelocations(dyn *dynamicInfo, plt *ProcedureLinkageTable, globalSymbolTable GlobalSymbolTable) ([]obj.RelocationEntry, error) {
+	t := plt.template
+	if dyn.pic && t.order != binary.BigEndian {
+		// le relocation del loader sono big endian come tutte le altre
+		return nil, fmt.Errorf("gli stub della PLT del target scelto non sono rilocabili dal loader")
+	}
+
+	b4 := obj.RelocationEntry{Kind: obj.BaseRelative4}
+	j4 := obj.RelocationEntry{Kind: obj.JumpSlot4}
+	plt0 := plt.Segment.StartAddress
+
+	var res []obj.RelocationEntry
+	add := func(address uint, segName string, re obj.RelocationEntry, symbolName string) error {
+		if re.Kind == obj.BaseRelative4 && !dyn.pic {
+			// in un eseguibile gli indirizzi assoluti sono già giusti
+			return nil
+		}
+		re, err := dyn.runtimeRelocation(re, address, segName, symbolName)
+		if err != nil {
+			return err
+		}
+		res = append(res, re)
+		return nil
+	}
+
+	if err := add(plt0+uint(t.headerGotPlus4), plt.Segment.Name, b4, ""); err != nil {
+		return nil, err
+	}
+	if err := add(plt0+uint(t.headerGotPlus8), plt.Segment.Name, b4, ""); err != nil {
+		return nil, err
+	}
+	for i, name := range plt.Symbols {
+		entryAddress, err := plt.entryAddress(name)
+		if err != nil {
+			return nil, err
+		}
+		if err := add(entryAddress+uint(t.entryGotSlot), plt.Segment.Name, b4, ""); err != nil {
+			return nil, err
+		}
+		slotAddress := plt.gotPltSlotAddress(uint(i))
+		if err := add(slotAddress, plt.GotPltSegment.Name, b4, ""); err != nil {
+			return nil, err
+		}
+		if globalSymbolTable[name].Symbol.Local {
+			continue
+		}
+		if err := add(slotAddress, plt.GotPltSegment.Name, j4, name); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
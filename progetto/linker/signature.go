@@ -0,0 +1,57 @@
+package linker
+
+import (
+	"errors"
+	"fmt"
+	obj "koltrakak/my-linker/objectformat"
+)
+
+/****** FIRME DEI SIMBOLI ******/
+
+// Se un file dichiara male un extern (int foo(char*) usato come foo(int)) il
+// linker lo lega lo stesso e il programma si schianta a run time. Quando sia il
+// riferimento che la definizione hanno la firma (vedi obj.Symbol) le confronto:
+// con -signatures error una firma diversa fa fallire il link, con
+// -signatures warn la segnalo e basta. Se uno dei due non ha la firma non
+// posso dire niente.
+
+const (
+	SIGNATURE_ERROR    = "error"
+	SIGNATURE_WARN     = "warn"
+	DEFAULT_SIGNATURES = SIGNATURE_ERROR
+)
+
+// checkSignatures confronta la firma dei riferimenti di inputObjs con quella
+// della definizione a cui sono stati legati
+func checkSignatures(inputObjs []*obj.MyObjectFormat, globalSymbolTable GlobalSymbolTable, policy string) error {
+	if policy == "" {
+		policy = DEFAULT_SIGNATURES
+	}
+	if policy != SIGNATURE_ERROR && policy != SIGNATURE_WARN {
+		return fmt.Errorf("politica per le firme dei simboli %q sconosciuta, quelle possibili sono %s e %s", policy, SIGNATURE_ERROR, SIGNATURE_WARN)
+	}
+
+	var errs []error
+	for _, io := range inputObjs {
+		for _, sym := range io.SymbolTable {
+			if sym.Kind != obj.Undefined || sym.Signature == "" {
+				continue
+			}
+			entry, ok := globalSymbolTable[symbolKey(sym)]
+			if !ok || entry.Symbol.Kind != obj.Defined || entry.Symbol.Signature == "" {
+				continue
+			}
+			if entry.Symbol.Signature == sym.Signature {
+				continue
+			}
+			err := fmt.Errorf("il simbolo %s è definito in %s come %s, ma %s lo usa come %s",
+				sym.VersionedName(), entry.FileName, entry.Symbol.Signature, io.Filename, sym.Signature)
+			if policy == SIGNATURE_ERROR {
+				errs = append(errs, err)
+			} else {
+				fmt.Println("### attenzione:", err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,353 @@
+package loader
+
+import (
+	"fmt"
+	obj "koltrakak/my-linker/objectformat"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+/****** DYNAMIC LINKING ******/
+
+// Il dynamic linker fa a tempo di caricamento il lavoro che il linker non ha potuto fare:
+// - sceglie dove caricare ogni libreria condivisa (che è linkata a partire da 0)
+// - applica le relocation rimaste nei file (B4, A4, R4, J4)
+// - risolve i simboli tra tutti i moduli caricati.
+// L'ordine di ricerca dei simboli è quello di ld.so: prima l'eseguibile, poi
+// le librerie nell'ordine in cui le ho caricate (breadth first). Le librerie
+// aperte con Dlopen non finiscono nello scope globale, per loro cerco prima
+// nello scope globale e poi tra le loro dipendenze.
+// Se il riferimento chiede una versione (foo@V1) va bene solo una definizione
+// con quella versione, altrimenti solo una senza versione o quella di default.
+
+const (
+	LIBRARY_BASE = 0x10000000 // le librerie le carico da qui in su
+	// il resolver non esiste davvero (non c'è nessuna CPU che esegua PLT0),
+	// in .got.plt[2] scrivo questo indirizzo e le chiamate lazy le simula BindSlot
+	RESOLVER_ADDRESS = 0xfffff000
+	// come nel linker: i primi 3 slot della .got.plt sono riservati, poi uno per stub
+	GOT_PLT_SLOT_SIZE     = 4
+	GOT_PLT_RESERVED_SLOT = 3
+)
+
+// Module è un file (eseguibile o libreria) caricato in memoria
+type Module struct {
+	Name  string
+	Image *obj.MyObjectFormat
+	Base  uint // quanto ho spostato il file rispetto a come è stato linkato
+
+	id        uint
+	deps      []*Module                    // librerie elencate in Needed
+	lazySlots map[uint]obj.RelocationEntry // J4 ancora da legare, per numero dello stub
+	refs      int                          // quante Dlopen lo tengono aperto
+}
+
+// scope restituisce il modulo con tutte le sue dipendenze, in ordine breadth first
+func (m *Module) scope() []*Module {
+	res := []*Module{m}
+	for i := 0; i < len(res); i++ {
+		for _, dep := range res[i].deps {
+			if !slices.Contains(res, dep) {
+				res = append(res, dep)
+			}
+		}
+	}
+	return res
+}
+
+// findLibrary cerca la libreria name prima nelle directory di LibraryPath e poi
+// in quella del file che ne ha bisogno
+func (p *Process) findLibrary(name string, requester *Module) (string, error) {
+	if filepath.IsAbs(name) || filepath.Base(name) != name {
+		return name, nil
+	}
+	dirs := append(slices.Clone(p.opts.LibraryPath), filepath.Dir(requester.Name))
+	for _, dir := range dirs {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("libreria %s richiesta da %s non trovata in %v", name, requester.Name, dirs)
+}
+
+// loadedModule restituisce il modulo già caricato dal file path, se c'è
+func (p *Process) loadedModule(path string) *Module {
+	for _, m := range p.Modules {
+		if filepath.Clean(m.Name) == filepath.Clean(path) {
+			return m
+		}
+	}
+	return nil
+}
+
+// loadLibrary mappa la libreria al primo indirizzo libero, senza rilocarla
+func (p *Process) loadLibrary(path string) (*Module, error) {
+	image, err := obj.ParseObjectFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if image.Header.Type != obj.SharedLibrary {
+		return nil, fmt.Errorf("%s non è una libreria condivisa (tipo %s)", path, image.Header.Type)
+	}
+
+	base := p.nextBase
+	m, err := p.mapModule(image, base)
+	if err != nil {
+		return nil, err
+	}
+	// la prossima libreria parte alla pagina dopo la fine di questa
+	var end uint
+	for _, seg := range image.SegmentTable {
+		end = max(end, seg.StartAddress+seg.Length)
+	}
+	p.nextBase = (base + end + PAGE_SIZE - 1) &^ (PAGE_SIZE - 1)
+	return m, nil
+}
+
+// loadDependencies carica (se non lo sono già) tutte le librerie di cui root ha bisogno,
+// direttamente o indirettamente. Restituisce root e le sue dipendenze in ordine breadth first
+func (p *Process) loadDependencies(root *Module) ([]*Module, error) {
+	queue := []*Module{root}
+	for i := 0; i < len(queue); i++ {
+		m := queue[i]
+		for _, name := range m.Image.Needed {
+			path, err := p.findLibrary(name, m)
+			if err != nil {
+				return nil, err
+			}
+			dep := p.loadedModule(path)
+			if dep == nil {
+				dep, err = p.loadLibrary(path)
+				if err != nil {
+					return nil, err
+				}
+			}
+			m.deps = append(m.deps, dep)
+			if !slices.Contains(queue, dep) {
+				queue = append(queue, dep)
+			}
+		}
+	}
+	return queue, nil
+}
+
+// matches dice se la definizione def soddisfa un riferimento a name nella versione version
+func matches(def *obj.Symbol, name string, version string) bool {
+	if def.Kind != obj.Defined || def.Name != name {
+		return false
+	}
+	if version == "" {
+		return def.Version == "" || def.DefaultVersion
+	}
+	return def.Version == version
+}
+
+// lookup cerca il simbolo name (nella versione version) tra i moduli di scope
+// e ne restituisce l'indirizzo a run time
+func lookup(name string, version string, scope []*Module) (uint, *Module, bool) {
+	for _, m := range scope {
+		for _, sym := range m.Image.SymbolTable {
+			if matches(sym, name, version) {
+				if sym.Segnum == 0 {
+					// simbolo assoluto, non si sposta con il modulo
+					return sym.Value, m, true
+				}
+				return m.Base + sym.Value, m, true
+			}
+		}
+	}
+	return 0, nil, false
+}
+
+// notFound costruisce l'errore per un simbolo che non c'è, dicendo quali
+// versioni ci sarebbero se il problema è la versione
+func notFound(name string, version string, scope []*Module) error {
+	if version == "" {
+		return fmt.Errorf("simbolo %s non definito da nessun modulo caricato", name)
+	}
+	var available []string
+	for _, m := range scope {
+		for _, sym := range m.Image.SymbolTable {
+			if sym.Kind == obj.Defined && sym.Name == name {
+				available = append(available, fmt.Sprintf("%s in %s", sym.VersionedName(), m.Name))
+			}
+		}
+	}
+	if len(available) == 0 {
+		return fmt.Errorf("simbolo %s@%s non definito da nessun modulo caricato", name, version)
+	}
+	return fmt.Errorf("versione %s del simbolo %s non trovata, ci sono solo: %s", version, name, strings.Join(available, ", "))
+}
+
+// resolve trova l'indirizzo a run time del simbolo numero ref di m
+func (p *Process) resolve(m *Module, ref uint, scope []*Module) (uint, error) {
+	if ref == 0 || ref > uint(len(m.Image.SymbolTable)) {
+		return 0, fmt.Errorf("%s: relocation con simbolo numero %d non esistente", m.Name, ref)
+	}
+	sym := m.Image.SymbolTable[ref-1]
+	addr, _, ok := lookup(sym.Name, sym.Version, scope)
+	if !ok {
+		return 0, fmt.Errorf("%s: %w", m.Name, notFound(sym.Name, sym.Version, scope))
+	}
+	return addr, nil
+}
+
+// relocate applica le relocation dinamiche di m, cercando i simboli in scope
+func (p *Process) relocate(m *Module, scope []*Module) error {
+	for _, re := range m.Image.RelocationTable {
+		if re.Segnum == 0 || re.Segnum > uint(len(m.Image.SegmentTable)) {
+			return fmt.Errorf("%s: relocation %s in un segnum non esistente: %d", m.Name, re.Kind, re.Segnum)
+		}
+		addr := m.Base + m.Image.SegmentTable[re.Segnum-1].StartAddress + re.Loc
+		// il loader può scrivere anche nei segmenti read only
+		cur := uint(be.Uint32(p.Memory.read(addr, 4)))
+
+		var val uint
+		switch re.Kind {
+		case obj.BaseRelative4:
+			val = cur + m.Base
+		case obj.Absolute4:
+			symAddr, err := p.resolve(m, re.Ref, scope)
+			if err != nil {
+				return err
+			}
+			val = cur + symAddr
+		case obj.Relative4:
+			symAddr, err := p.resolve(m, re.Ref, scope)
+			if err != nil {
+				return err
+			}
+			val = cur + symAddr - addr
+		case obj.JumpSlot4:
+			if p.opts.Lazy {
+				// lo slot continua a puntare al suo stub, ci pensa BindSlot.
+				// Lo stub passa al resolver il suo numero, che ricavo dallo slot:
+				// non tutti gli stub hanno una J4 (quelli di funzioni locali no)
+				index, err := pltIndex(m, re)
+				if err != nil {
+					return err
+				}
+				if m.lazySlots == nil {
+					m.lazySlots = map[uint]obj.RelocationEntry{}
+				}
+				m.lazySlots[index] = re
+				continue
+			}
+			symAddr, err := p.resolve(m, re.Ref, scope)
+			if err != nil {
+				return err
+			}
+			val = symAddr
+		default:
+			return fmt.Errorf("%s: relocation dinamica di tipo %s non supportata", m.Name, re.Kind)
+		}
+		p.Memory.write(addr, putUint32(uint32(val)))
+	}
+
+	if p.opts.Lazy {
+		p.setupLazyBinding(m)
+	}
+	return nil
+}
+
+// pltIndex restituisce il numero dello stub della PLT che usa lo slot della J4 re
+func pltIndex(m *Module, re obj.RelocationEntry) (uint, error) {
+	seg := m.Image.SegmentTable[re.Segnum-1]
+	if seg.Name != ".got.plt" || re.Loc < GOT_PLT_RESERVED_SLOT*GOT_PLT_SLOT_SIZE || re.Loc%GOT_PLT_SLOT_SIZE != 0 {
+		return 0, fmt.Errorf("%s: relocation %s all'indirizzo %#x di %s, non è uno slot della .got.plt", m.Name, re.Kind, re.Loc, seg.Name)
+	}
+	return re.Loc/GOT_PLT_SLOT_SIZE - GOT_PLT_RESERVED_SLOT, nil
+}
+
+// setupLazyBinding riempie gli slot riservati della .got.plt: [1] identifica il
+// modulo e [2] è il resolver a cui salta PLT0
+func (p *Process) setupLazyBinding(m *Module) {
+	for _, seg := range m.Image.SegmentTable {
+		if seg.Name == ".got.plt" && seg.Length >= 12 {
+			gotPlt := m.Base + seg.StartAddress
+			p.Memory.write(gotPlt+4, putUint32(uint32(m.id)))
+			p.Memory.write(gotPlt+8, putUint32(RESOLVER_ADDRESS))
+		}
+	}
+}
+
+// BindSlot simula il resolver chiamato da PLT0 la prima volta che si passa
+// dallo stub numero index di m: lega lo slot alla funzione e ne restituisce l'indirizzo
+func (p *Process) BindSlot(m *Module, index uint) (uint, error) {
+	re, ok := m.lazySlots[index]
+	if !ok {
+		return 0, fmt.Errorf("%s: nessuno slot lazy numero %d", m.Name, index)
+	}
+	scope := p.globalScope
+	if !slices.Contains(scope, m) {
+		scope = append(slices.Clone(scope), m.scope()...)
+	}
+	symAddr, err := p.resolve(m, re.Ref, scope)
+	if err != nil {
+		return 0, err
+	}
+	addr := m.Base + m.Image.SegmentTable[re.Segnum-1].StartAddress + re.Loc
+	p.Memory.write(addr, putUint32(uint32(symAddr)))
+	return symAddr, nil
+}
+
+// Dlopen carica a run time la libreria name con le sue dipendenze. Se è già
+// caricata restituisce lo stesso modulo
+func (p *Process) Dlopen(name string) (*Module, error) {
+	path, err := p.findLibrary(name, p.Modules[0])
+	if err != nil {
+		return nil, err
+	}
+	if m := p.loadedModule(path); m != nil {
+		m.refs++
+		return m, nil
+	}
+
+	firstNew := len(p.Modules)
+	m, err := p.loadLibrary(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.loadDependencies(m); err != nil {
+		return nil, err
+	}
+	// rilocando i nuovi moduli cerco prima nello scope globale e poi tra
+	// le dipendenze della libreria aperta
+	scope := append(slices.Clone(p.globalScope), m.scope()...)
+	for _, newModule := range p.Modules[firstNew:] {
+		if err := p.relocate(newModule, scope); err != nil {
+			return nil, err
+		}
+	}
+	m.refs++
+	return m, nil
+}
+
+// Dlsym restituisce l'indirizzo del simbolo name cercandolo in handle e nelle sue
+// dipendenze. Con handle nil cerca nello scope globale. Per chiedere una
+// versione precisa name è nella forma foo@V1
+func (p *Process) Dlsym(handle *Module, name string) (uint, error) {
+	scope := p.globalScope
+	if handle != nil {
+		scope = handle.scope()
+	}
+	name, version, _ := strings.Cut(name, "@")
+	addr, _, ok := lookup(name, version, scope)
+	if !ok {
+		return 0, notFound(name, version, scope)
+	}
+	return addr, nil
+}
+
+// Dlclose rilascia un modulo aperto con Dlopen. La memoria non la libero:
+// lo spazio di indirizzamento è simulato e non mi serve riutilizzarlo
+func (p *Process) Dlclose(handle *Module) error {
+	if handle.refs == 0 {
+		return fmt.Errorf("%s non è stato aperto con Dlopen", handle.Name)
+	}
+	handle.refs--
+	return nil
+}
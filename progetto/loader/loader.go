@@ -0,0 +1,141 @@
+// Package loader definisce il mio loader: carica le immagini prodotte dal linker
+// in uno spazio di indirizzamento simulato, così posso verificarle senza hardware
+package loader
+
+import (
+	"fmt"
+	obj "koltrakak/my-linker/objectformat"
+	"math/rand/v2"
+)
+
+// Options raccoglie le opzioni che modificano il comportamento del loader
+type Options struct {
+	LibraryPath []string // directory in cui cercare le librerie condivise (oltre a quella di chi le chiede)
+	Lazy        bool     // lega gli slot della .got.plt solo quando qualcuno chiama la funzione
+	// indirizzo a cui caricare il primo segmento di un eseguibile rilocabile,
+	// 0 vuol dire dove è stato linkato
+	ImageBase uint
+	// sceglie a caso dove caricare eseguibile (se rilocabile) e librerie, come ASLR
+	RandomBase bool
+}
+
+// gli eseguibili rilocabili li sposto a caso in questo intervallo
+const (
+	RANDOM_IMAGE_MIN = 0x00400000
+	RANDOM_IMAGE_MAX = LIBRARY_BASE
+)
+
+// Process è un'immagine caricata in memoria insieme alle librerie di cui ha bisogno
+type Process struct {
+	Image   *obj.MyObjectFormat
+	Memory  *Memory
+	Modules []*Module // eseguibile e librerie nell'ordine in cui li ho caricati
+	Entry   uint      // indirizzo da cui parte l'esecuzione, già spostato come l'eseguibile
+
+	opts        Options
+	globalScope []*Module // dove cerco i simboli: eseguibile e poi le librerie caricate all'avvio
+	nextBase    uint      // prossimo indirizzo libero per una libreria
+}
+
+func LoadFile(filename string, opts Options) (*Process, error) {
+	image, err := obj.ParseObjectFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return Load(image, opts)
+}
+
+// imageExtent restituisce il primo e l'ultimo indirizzo occupati dai segmenti di image
+func imageExtent(image *obj.MyObjectFormat) (uint, uint) {
+	var start, end uint
+	first := true
+	for _, seg := range image.SegmentTable {
+		if seg.Length == 0 {
+			continue
+		}
+		if first || seg.StartAddress < start {
+			start = seg.StartAddress
+		}
+		end = max(end, seg.StartAddress+seg.Length)
+		first = false
+	}
+	return start, end
+}
+
+// Load mappa ogni segmento dell'eseguibile al suo StartAddress (o, se è
+// rilocabile, a partire da ImageBase), poi carica le librerie condivise
+// di cui ha bisogno e applica le relocation dinamiche
+func Load(image *obj.MyObjectFormat, opts Options) (*Process, error) {
+	if image.Header.Type != obj.Executable && image.Header.Type != obj.RelocatableExecutable {
+		return nil, fmt.Errorf("%s non è un eseguibile (tipo %s)", image.Filename, image.Header.Type)
+	}
+
+	p := &Process{
+		Image:    image,
+		Memory:   NewMemory(),
+		opts:     opts,
+		nextBase: LIBRARY_BASE,
+	}
+
+	// Un eseguibile normale non si sposta, base 0. Uno rilocabile lo posso
+	// mettere dove voglio: le sue B4 sommano di quanto l'ho spostato
+	start, end := imageExtent(image)
+	imageBase := opts.ImageBase
+	if opts.RandomBase && image.Header.Type == obj.RelocatableExecutable {
+		pages := (RANDOM_IMAGE_MAX - RANDOM_IMAGE_MIN - (end - start)) / PAGE_SIZE
+		imageBase = RANDOM_IMAGE_MIN + rand.UintN(pages)*PAGE_SIZE
+	}
+	if opts.RandomBase {
+		p.nextBase += rand.UintN(0x1000) * PAGE_SIZE
+	}
+	var delta uint
+	if imageBase != 0 {
+		if imageBase%PAGE_SIZE != 0 {
+			return nil, fmt.Errorf("l'indirizzo di caricamento %#x non è allineato alla pagina", imageBase)
+		}
+		if image.Header.Type != obj.RelocatableExecutable {
+			return nil, fmt.Errorf("%s non ha le base relocation, non posso caricarlo a %#x", image.Filename, imageBase)
+		}
+		if imageBase+(end-start) > p.nextBase {
+			return nil, fmt.Errorf("caricato a %#x, %s si sovrapporrebbe alle librerie condivise", imageBase, image.Filename)
+		}
+		// NB: se sposto l'immagine in basso delta è "negativo", ma con
+		// l'aritmetica modulare degli unsigned gli indirizzi tornano lo stesso
+		delta = imageBase - start
+	}
+	exe, err := p.mapModule(image, delta)
+	if err != nil {
+		return nil, err
+	}
+	p.Entry = image.Header.EntryPoint + delta
+
+	// le librerie caricate all'avvio finiscono tutte nello scope globale,
+	// in ordine breadth first come fa ld.so
+	loaded, err := p.loadDependencies(exe)
+	if err != nil {
+		return nil, err
+	}
+	p.globalScope = loaded
+	for _, m := range loaded {
+		if err := p.relocate(m, p.globalScope); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func (p *Process) mapModule(image *obj.MyObjectFormat, base uint) (*Module, error) {
+	m := &Module{
+		Name:  image.Filename,
+		Image: image,
+		Base:  base,
+		id:    uint(len(p.Modules)),
+	}
+	for i, seg := range image.SegmentTable {
+		if err := p.Memory.mapSegment(seg, image.Data[i], base); err != nil {
+			return nil, fmt.Errorf("impossibile caricare %s: %w", image.Filename, err)
+		}
+	}
+	p.Modules = append(p.Modules, m)
+	return m, nil
+}
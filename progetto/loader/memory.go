@@ -0,0 +1,223 @@
+package loader
+
+import (
+	"encoding/binary"
+	"fmt"
+	obj "koltrakak/my-linker/objectformat"
+	"sort"
+)
+
+const PAGE_SIZE = 4096
+
+// come nel linker, tutti i valori da 4 byte sono big endian
+var be = binary.BigEndian
+
+func putUint32(v uint32) []byte {
+	b := make([]byte, 4)
+	be.PutUint32(b, v)
+	return b
+}
+
+// Fault è l'errore che ottengo quando accedo a memoria non mappata o senza i permessi giusti,
+// l'equivalente simulato di un segmentation fault
+type Fault struct {
+	Addr   uint
+	Write  bool
+	Reason string
+}
+
+func (f *Fault) Error() string {
+	access := "lettura"
+	if f.Write {
+		access = "scrittura"
+	}
+	return fmt.Sprintf("fault in %s all'indirizzo %#x: %s", access, f.Addr, f.Reason)
+}
+
+// Mapping è un intervallo di indirizzi [Start, Start+Length) con i permessi del segmento che ci ho caricato
+type Mapping struct {
+	Name       string
+	Start      uint
+	Length     uint
+	Readable   bool
+	Writable   bool
+	Executable bool
+	Overlay    bool // ci si alternano gli overlay di un gruppo
+}
+
+func (m *Mapping) end() uint {
+	return m.Start + m.Length
+}
+
+// Memory è uno spazio di indirizzamento sparso: le pagine vengono allocate solo
+// quando qualcuno ci scrive, quelle mai toccate valgono zero
+type Memory struct {
+	mappings []*Mapping      // ordinati per Start, non si sovrappongono
+	pages    map[uint][]byte // numero di pagina -> contenuto
+}
+
+func NewMemory() *Memory {
+	return &Memory{pages: map[uint][]byte{}}
+}
+
+// Map aggiunge un mapping, fallisce se si sovrappone a uno esistente
+func (m *Memory) Map(mapping Mapping) error {
+	if mapping.Length == 0 {
+		return nil
+	}
+	for _, other := range m.mappings {
+		if mapping.Start < other.end() && other.Start < mapping.end() {
+			return fmt.Errorf("il segmento %s [%#x, %#x) si sovrappone a %s [%#x, %#x)",
+				mapping.Name, mapping.Start, mapping.end(), other.Name, other.Start, other.end())
+		}
+	}
+	m.mappings = append(m.mappings, &mapping)
+	sort.Slice(m.mappings, func(i, j int) bool { return m.mappings[i].Start < m.mappings[j].Start })
+	return nil
+}
+
+// Mappings restituisce i mapping in ordine di indirizzo
+func (m *Memory) Mappings() []*Mapping {
+	return m.mappings
+}
+
+func (m *Memory) findMapping(addr uint) *Mapping {
+	i := sort.Search(len(m.mappings), func(i int) bool { return m.mappings[i].end() > addr })
+	if i < len(m.mappings) && m.mappings[i].Start <= addr {
+		return m.mappings[i]
+	}
+	return nil
+}
+
+// check controlla che tutti i byte di [addr, addr+n) siano mappati con il permesso richiesto
+func (m *Memory) check(addr uint, n uint, write bool) error {
+	for cur := addr; cur < addr+n; {
+		mapping := m.findMapping(cur)
+		if mapping == nil {
+			return &Fault{Addr: cur, Write: write, Reason: "indirizzo non mappato"}
+		}
+		if write && !mapping.Writable {
+			return &Fault{Addr: cur, Write: write, Reason: fmt.Sprintf("il segmento %s non è scrivibile", mapping.Name)}
+		}
+		if !write && !mapping.Readable {
+			return &Fault{Addr: cur, Write: write, Reason: fmt.Sprintf("il segmento %s non è leggibile", mapping.Name)}
+		}
+		cur = mapping.end()
+	}
+	return nil
+}
+
+// Read legge n byte a partire da addr rispettando i permessi
+func (m *Memory) Read(addr uint, n uint) ([]byte, error) {
+	if err := m.check(addr, n, false); err != nil {
+		return nil, err
+	}
+	return m.read(addr, n), nil
+}
+
+// Write scrive data a partire da addr rispettando i permessi
+func (m *Memory) Write(addr uint, data []byte) error {
+	if err := m.check(addr, uint(len(data)), true); err != nil {
+		return err
+	}
+	m.write(addr, data)
+	return nil
+}
+
+func (m *Memory) ReadUint32(addr uint) (uint32, error) {
+	b, err := m.Read(addr, 4)
+	if err != nil {
+		return 0, err
+	}
+	return be.Uint32(b), nil
+}
+
+func (m *Memory) WriteUint32(addr uint, v uint32) error {
+	return m.Write(addr, putUint32(v))
+}
+
+// read e write non controllano i permessi, le usa il loader per
+// preparare l'immagine (che deve poter scrivere anche in .text)
+func (m *Memory) read(addr uint, n uint) []byte {
+	res := make([]byte, n)
+	for i := range n {
+		page, ok := m.pages[(addr+i)/PAGE_SIZE]
+		if ok {
+			res[i] = page[(addr+i)%PAGE_SIZE]
+		}
+	}
+	return res
+}
+
+func (m *Memory) write(addr uint, data []byte) {
+	for i, b := range data {
+		pageNum := (addr + uint(i)) / PAGE_SIZE
+		page, ok := m.pages[pageNum]
+		if !ok {
+			page = make([]byte, PAGE_SIZE)
+			m.pages[pageNum] = page
+		}
+		page[(addr+uint(i))%PAGE_SIZE] = b
+	}
+}
+
+// mapSegment mappa seg spostato di base e ci copia i suoi dati. I segmenti
+// non presenti (come .bss) non hanno dati: restano a zero
+func (m *Memory) mapSegment(seg *obj.Segment, data obj.SegmentData, base uint) error {
+	if seg.Flags[obj.Overlay] {
+		return m.mapOverlay(seg, base)
+	}
+	err := m.Map(Mapping{
+		Name:       seg.Name,
+		Start:      base + seg.StartAddress,
+		Length:     seg.Length,
+		Readable:   seg.Flags[obj.Readable],
+		Writable:   seg.Flags[obj.Writable],
+		Executable: seg.Flags[obj.Runnable],
+	})
+	if err != nil {
+		return err
+	}
+	if !seg.Flags[obj.Present] {
+		return nil
+	}
+	if uint(len(data)) < seg.Length {
+		return fmt.Errorf("il segmento %s ha %d byte di dati ma è lungo %d", seg.Name, len(data), seg.Length)
+	}
+	m.write(base+seg.StartAddress, data[:seg.Length])
+	return nil
+}
+
+// mapOverlay mappa l'intervallo di un segmento overlay senza copiarci i dati, li
+// carica l'overlay manager quando servono (vedi LoadOverlay). Gli overlay dello
+// stesso gruppo condividono gli indirizzi: se l'intervallo si sovrappone a quello
+// di un altro overlay allargo il suo mapping invece di fallire
+func (m *Memory) mapOverlay(seg *obj.Segment, base uint) error {
+	start := base + seg.StartAddress
+	end := start + seg.Length
+	for _, other := range m.mappings {
+		if !(start < other.end() && other.Start < end) {
+			continue
+		}
+		if !other.Overlay {
+			break // ci pensa Map a riportare l'errore
+		}
+		newEnd := max(end, other.end())
+		other.Start = min(start, other.Start)
+		other.Length = newEnd - other.Start
+		other.Name += "|" + seg.Name
+		other.Readable = other.Readable || seg.Flags[obj.Readable]
+		other.Writable = other.Writable || seg.Flags[obj.Writable]
+		other.Executable = other.Executable || seg.Flags[obj.Runnable]
+		return nil
+	}
+	return m.Map(Mapping{
+		Name:       seg.Name,
+		Start:      start,
+		Length:     seg.Length,
+		Readable:   seg.Flags[obj.Readable],
+		Writable:   seg.Flags[obj.Writable],
+		Executable: seg.Flags[obj.Runnable],
+		Overlay:    true,
+	})
+}
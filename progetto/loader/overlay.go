@@ -0,0 +1,51 @@
+package loader
+
+import (
+	"fmt"
+	obj "koltrakak/my-linker/objectformat"
+	"slices"
+)
+
+// LoadOverlay fa il lavoro dell'overlay manager: copia in memoria i dati
+// dell'overlay name del modulo m e lo segna come residente nella tabella degli
+// overlay (.ovtab, vedi linker/overlay.go). L'overlay che c'era prima nello
+// stesso gruppo viene semplicemente sovrascritto
+func (p *Process) LoadOverlay(m *Module, name string) error {
+	image := m.Image
+	segIdx := slices.IndexFunc(image.SegmentTable, func(s *obj.Segment) bool { return s.Name == name })
+	if segIdx < 0 || !image.SegmentTable[segIdx].Flags[obj.Overlay] {
+		return fmt.Errorf("%s non ha un overlay %s", m.Name, name)
+	}
+	tabIdx := slices.IndexFunc(image.SegmentTable, func(s *obj.Segment) bool { return s.Name == ".ovtab" })
+	if tabIdx < 0 {
+		return fmt.Errorf("%s ha degli overlay ma non la loro tabella", m.Name)
+	}
+	tab := m.Base + image.SegmentTable[tabIdx].StartAddress
+
+	// cerco la entry dell'overlay, il manager la riconosce dal segnum
+	n, err := p.Memory.ReadUint32(tab)
+	if err != nil {
+		return err
+	}
+	for i := range uint(n) {
+		entry := tab + 8 + i*16
+		segnum, err := p.Memory.ReadUint32(entry)
+		if err != nil {
+			return err
+		}
+		if uint(segnum) != uint(segIdx)+1 {
+			continue
+		}
+		seg := image.SegmentTable[segIdx]
+		if seg.Flags[obj.Present] {
+			// è il manager che scrive, quindi ignoro i permessi del segmento
+			p.Memory.write(m.Base+seg.StartAddress, image.Data[segIdx][:seg.Length])
+		}
+		groupWord, err := p.Memory.ReadUint32(entry + 12)
+		if err != nil {
+			return err
+		}
+		return p.Memory.WriteUint32(uint(groupWord), uint32(i))
+	}
+	return fmt.Errorf("l'overlay %s non compare nella tabella degli overlay di %s", name, m.Name)
+}
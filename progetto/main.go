@@ -1,25 +1,89 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	lnk "koltrakak/my-linker/linker"
+	ldr "koltrakak/my-linker/loader"
 	"log"
 	"os"
+	"strings"
 )
 
+// stringList è un flag che si può ripetere, ogni occorrenza aggiunge un valore
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
 func main() {
-	if len(os.Args) < 3 {
+	// my-linker run immagine.lk carica un eseguibile invece di linkare
+	if len(os.Args) > 1 && os.Args[1] == "run" {
+		run(os.Args[2:])
+		return
+	}
+
+	var opts lnk.Options
+	var keep, wrap stringList
+	flag.IntVar(&opts.Jobs, "j", 0, "numero massimo di worker per le fasi parallele (0 = uno per CPU)")
+	flag.StringVar(&opts.Target, "target", lnk.DEFAULT_TARGET, "architettura di cui generare gli stub della PLT")
+	flag.BoolVar(&opts.Shared, "shared", false, "produce una libreria condivisa invece di un eseguibile")
+	flag.BoolVar(&opts.BaseRelocs, "base-relocs", false, "mantiene le relocation che servono al loader per spostare l'eseguibile")
+	flag.StringVar(&opts.Layout, "layout", "", "file di layout con i gruppi di overlay")
+	flag.BoolVar(&opts.Incremental, "incremental", false, "se possibile patcha l'output precedente invece di rifare tutto il link")
+	flag.BoolVar(&opts.GCSections, "gc-sections", false, "scarta i segmenti che non si raggiungono dal simbolo di ingresso")
+	flag.StringVar(&opts.Entry, "e", "", "simbolo da cui parte l'esecuzione (default main o _start)")
+	flag.Var(&keep, "keep", "simbolo da tenere con -gc-sections anche se nessuno lo usa (ripetibile)")
+	flag.StringVar(&opts.SegmentFlags, "segment-flags", lnk.DEFAULT_SEGMENT_FLAGS, "come unire le flag di segmenti con lo stesso nome: union, intersection o error")
+	flag.StringVar(&opts.WX, "wx", lnk.DEFAULT_WX, "cosa fare con i segmenti scrivibili ed eseguibili: error o warn")
+	flag.StringVar(&opts.Signatures, "signatures", lnk.DEFAULT_SIGNATURES, "cosa fare se un simbolo è usato con una firma diversa da quella della definizione: error o warn")
+	flag.Var(&wrap, "wrap", "i riferimenti a sym vanno a __wrap_sym e quelli a __real_sym a sym (ripetibile)")
+	flag.Func("rename", "rinomina un simbolo globale: vecchio=nuovo (ripetibile)", func(s string) error {
+		oldName, newName, err := lnk.ParseRename(s)
+		if err != nil {
+			return err
+		}
+		if _, ok := opts.Rename[oldName]; ok {
+			return fmt.Errorf("-rename %s: %s è già stato rinominato", s, oldName)
+		}
+		if opts.Rename == nil {
+			opts.Rename = map[string]string{}
+		}
+		opts.Rename[oldName] = newName
+		return nil
+	})
+	flag.Func("defsym", "definisce un simbolo: nome=valore, nome=simbolo o nome=simbolo+offset (ripetibile)", func(s string) error {
+		d, err := lnk.ParseDefsym(s)
+		if err != nil {
+			return err
+		}
+		opts.Defsyms = append(opts.Defsyms, d)
+		return nil
+	})
+	flag.Parse()
+	opts.Keep = keep
+	opts.Wrap = wrap
+
+	args := flag.Args()
+	if len(args) < 2 {
 		log.Fatal("ho bisogno di almeno un file oggetto in input come argomento, e il file di output come ultimo argomento")
 	}
 
 	// var o *obj.MyObjectFormat
-	// o, err := obj.ParseObjectFile(os.Args[1])
+	// o, err := obj.ParseObjectFile(args[0])
 	// if err != nil {
 	// 	log.Fatalln(err)
 	// }
 	// fmt.Println(o)
 
-	outObj, err := lnk.Link(os.Args[1 : len(os.Args)-1])
+	opts.Output = args[len(args)-1]
+	outObj, err := lnk.Link(args[:len(args)-1], opts)
 	if err != nil {
 		log.Fatalln(err)
 	}
@@ -27,10 +91,55 @@ func main() {
 	// fmt.Println(outObj)
 
 	// TODO: aggiungi questo dentro link
-	outObj.Filename = os.Args[len(os.Args)-1]
+	outObj.Filename = args[len(args)-1]
 
 	err = outObj.WriteObjectFile(outObj.Filename)
 	if err != nil {
 		log.Fatalln(err)
 	}
 }
+
+func run(args []string) {
+	var opts ldr.Options
+	var libraryPath, overlays stringList
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	fs.Var(&libraryPath, "L", "directory in cui cercare le librerie condivise (ripetibile)")
+	fs.BoolVar(&opts.Lazy, "lazy", false, "lega le funzioni delle librerie solo alla prima chiamata")
+	fs.UintVar(&opts.ImageBase, "base", 0, "indirizzo a cui caricare un eseguibile rilocabile (0 = dove è stato linkato)")
+	fs.BoolVar(&opts.RandomBase, "aslr", false, "carica eseguibile rilocabile e librerie a indirizzi casuali")
+	fs.Var(&overlays, "overlay", "overlay da caricare dopo l'avvio, come farebbe l'overlay manager (ripetibile)")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		log.Fatal("uso: my-linker run [-L dir] [-lazy] [-base addr] [-aslr] [-overlay seg] <eseguibile>")
+	}
+	opts.LibraryPath = libraryPath
+
+	p, err := ldr.LoadFile(fs.Arg(0), opts)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	for _, name := range overlays {
+		if err := p.LoadOverlay(p.Modules[0], name); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	fmt.Printf("### entry point %08x\n", p.Entry)
+	fmt.Println("### moduli")
+	for _, m := range p.Modules {
+		fmt.Printf("%08x %s\n", m.Base, m.Name)
+	}
+	fmt.Println("### memory map")
+	for _, m := range p.Memory.Mappings() {
+		perms := []byte("---")
+		if m.Readable {
+			perms[0] = 'r'
+		}
+		if m.Writable {
+			perms[1] = 'w'
+		}
+		if m.Executable {
+			perms[2] = 'x'
+		}
+		fmt.Printf("%08x-%08x %s %s\n", m.Start, m.Start+m.Length, perms, m.Name)
+	}
+}
@@ -12,18 +12,65 @@ import (
 
 const LINK string = "LINK"
 
+// Dopo i tre numeri dell'header può esserci il tipo del file:
+// O per un file oggetto (il default se manca), E per un eseguibile,
+// R per un eseguibile che si porta dietro le relocation per essere spostato
+// (come le base relocation dei PE) e S per una libreria condivisa.
+// Dopo il tipo può esserci il numero di librerie condivise di cui il file ha
+// bisogno, i loro nomi sono elencati uno per riga dopo le relocation.
+// Negli eseguibili c'è infine l'entry point in esadecimale, l'indirizzo da cui
+// il loader fa partire l'esecuzione.
+type ObjType int
+
+const (
+	Object ObjType = iota
+	Executable
+	RelocatableExecutable
+	SharedLibrary
+)
+
+var objTypeParsingMap = map[string]ObjType{
+	"O": Object,
+	"E": Executable,
+	"R": RelocatableExecutable,
+	"S": SharedLibrary,
+}
+
+func (t ObjType) String() string {
+	switch t {
+	case Object:
+		return "O"
+	case Executable:
+		return "E"
+	case RelocatableExecutable:
+		return "R"
+	case SharedLibrary:
+		return "S"
+	default:
+		return "?"
+	}
+}
+
 type ObjHeader struct {
 	SegmentNum           uint
 	SymbolNum            uint
 	RelocationEntriesNum uint
+	Type                 ObjType
+	NeededNum            uint
+	EntryPoint           uint // hex value, solo negli eseguibili
 }
 
+// Oltre a R, W e P c'è O per i segmenti overlay: condividono gli indirizzi con
+// gli altri overlay del loro gruppo e li carica in memoria l'overlay manager
+// quando servono, non il loader all'avvio. X dice che il segmento contiene codice
 type SegmentFlag int
 
 const (
 	Readable SegmentFlag = iota
 	Writable
 	Present
+	Overlay
+	Runnable // non Executable, c'è già il tipo di file
 )
 
 func (f SegmentFlag) String() string {
@@ -34,6 +81,10 @@ func (f SegmentFlag) String() string {
 		return "W"
 	case Present:
 		return "P"
+	case Overlay:
+		return "O"
+	case Runnable:
+		return "X"
 	default:
 		return "?"
 	}
@@ -43,6 +94,22 @@ var segmentFlagParsingMap = map[string]SegmentFlag{
 	"R": Readable,
 	"W": Writable,
 	"P": Present,
+	"O": Overlay,
+	"X": Runnable,
+}
+
+// ordine in cui scrivo le flag, iterare sulla mappa darebbe un ordine casuale
+var segmentFlagOrder = []SegmentFlag{Readable, Writable, Runnable, Present, Overlay}
+
+// FormatSegmentFlags scrive le flag come nel file oggetto, es. RWP
+func FormatSegmentFlags(flags map[SegmentFlag]bool) string {
+	res := ""
+	for _, f := range segmentFlagOrder {
+		if flags[f] {
+			res += f.String()
+		}
+	}
+	return res
 }
 
 func parseSegmentFlags(segmentFlags string) (map[SegmentFlag]bool, error) {
@@ -60,11 +127,17 @@ func parseSegmentFlags(segmentFlags string) (map[SegmentFlag]bool, error) {
 	return res, nil
 }
 
+// Dopo le flag ci può essere la chiave di un gruppo COMDAT, es.
+// .text.max 0 40 RXP _Z3maxii
+// I segmenti con la stessa chiave sono copie della stessa roba (tipo le istanze
+// di un template C++ generate in ogni file che le usa): il linker ne tiene una
+// sola, insieme ai simboli definiti lì dentro.
 type Segment struct {
 	Name         string
 	StartAddress uint // hex value
 	Length       uint // in bytes
 	Flags        map[SegmentFlag]bool
+	Group        string // chiave del gruppo COMDAT, vuota se il segmento non è in un gruppo
 }
 
 // Next comes the symbol table. Each entry is of the form:
@@ -74,6 +147,14 @@ type Segment struct {
 // Seg is the segment number relative to which the symbol is defined, or 0 for absolute or undefined symbols.
 // The kind is a string of letters including D for defined or U for undefined.
 // Symbols are also numbered in the order they’re listed, starting at 1.
+//
+// Nel kind ci può essere anche il binding: L per i simboli locali (come gli static
+// del C), visibili solo dal file che li definisce, oppure G per quelli globali,
+// che è il default. Un simbolo non definito non può essere locale.
+//
+// Dopo il kind ci può essere la firma del simbolo, cioè il suo tipo scritto senza
+// spazi (es. il tipo mangled FiPcE per int foo(char*)). Se ce l'hanno sia la
+// definizione che un riferimento il linker controlla che siano uguali.
 type symbolKind int
 
 const (
@@ -97,19 +178,73 @@ func (sk symbolKind) String() string {
 	}
 }
 
-func parseSymbolKind(kind string) (symbolKind, error) {
-	if v, ok := symbolKindParsingMap[kind]; ok {
-		return v, nil
+// parseSymbolKind restituisce il tipo del simbolo e se è locale
+func parseSymbolKind(kind string) (symbolKind, bool, error) {
+	local := false
+	rest := ""
+	for _, c := range kind {
+		switch c {
+		case 'L':
+			local = true
+		case 'G':
+			local = false
+		default:
+			rest += string(c)
+		}
 	}
-
-	return 0, fmt.Errorf("symbolKind %s non riconosciuto", kind)
+	v, ok := symbolKindParsingMap[rest]
+	if !ok {
+		return 0, false, fmt.Errorf("symbolKind %s non riconosciuto", kind)
+	}
+	if local && v == Undefined {
+		return 0, false, fmt.Errorf("symbolKind %s: un simbolo non definito non può essere locale", kind)
+	}
+	return v, local, nil
 }
 
+// Nelle librerie condivise il nome di un simbolo può avere una versione:
+// foo@V1 è la versione V1 di foo, foo@@V2 è la versione V2 ed è quella di
+// default, cioè quella a cui si legano i riferimenti a foo senza versione.
+// Un riferimento (U) foo@V1 vuole esattamente la versione V1.
 type Symbol struct {
-	Name   string
-	Value  uint // hex value
-	Segnum uint
-	Kind   symbolKind
+	Name           string
+	Value          uint // hex value
+	Segnum         uint
+	Kind           symbolKind
+	Version        string // vuota se il simbolo non ha versione
+	DefaultVersion bool
+	Local          bool   // visibile solo nel file che lo definisce
+	Signature      string // tipo del simbolo, vuoto se non si sa
+}
+
+// parseSymbolName separa nome e versione di un simbolo
+func parseSymbolName(s *Symbol, versionedName string) error {
+	name, version, found := strings.Cut(versionedName, "@")
+	s.Name = name
+	if !found {
+		return nil
+	}
+	if strings.HasPrefix(version, "@") {
+		s.DefaultVersion = true
+		version = version[1:]
+	}
+	if name == "" || version == "" || strings.Contains(version, "@") {
+		return fmt.Errorf("nome di simbolo versionato non valido: %s", versionedName)
+	}
+	s.Version = version
+	return nil
+}
+
+// VersionedName restituisce il nome del simbolo nella forma in cui compare nel file
+func (s *Symbol) VersionedName() string {
+	switch {
+	case s.Version == "":
+		return s.Name
+	case s.DefaultVersion:
+		return s.Name + "@@" + s.Version
+	default:
+		return s.Name + "@" + s.Version
+	}
 }
 
 // Next come the relocations, one to a line:
@@ -121,14 +256,41 @@ type Symbol struct {
 // Some relocation types may have extra fields after the type.
 type relocationKind int
 
+// Per il codice position independent ci sono anche le relocation che passano dalla GOT:
+// GL4 è lo spiazzamento relativo dalla location allo slot della GOT del simbolo (ci carico
+// l'indirizzo del simbolo), GO4 è l'offset dello slot del simbolo dall'inizio della GOT.
+// P4 è una chiamata relativa che invece di andare direttamente al simbolo passa dal suo stub nella PLT.
+//
+// Le librerie condivise si portano dietro le relocation che deve fare il loader, in quel caso
+// loc è l'offset nel segmento di output e ref il numero del simbolo nella symbol table dinamica.
+// Oltre ad A4 e R4 ci sono B4, a cui va sommato l'indirizzo base a cui viene caricato il file
+// (ref è 0), e J4, uno slot della .got.plt che va sovrascritto con l'indirizzo del simbolo ref.
+//
+// SA4 e SR4 sono come A4 e R4 ma ref è il numero di un segmento del file invece che di un
+// simbolo: la location contiene l'offset dall'inizio di quel segmento. Servono per riferirsi
+// a dati locali senza dover inventare un simbolo.
 const (
 	Absolute4 relocationKind = iota
 	Relative4
+	GotLoad4
+	GotOffset4
+	PltCall4
+	BaseRelative4
+	JumpSlot4
+	SegmentAbsolute4
+	SegmentRelative4
 )
 
 var relocationKindParsingMap = map[string]relocationKind{
-	"A4": Absolute4,
-	"R4": Relative4,
+	"A4":  Absolute4,
+	"R4":  Relative4,
+	"GL4": GotLoad4,
+	"GO4": GotOffset4,
+	"P4":  PltCall4,
+	"B4":  BaseRelative4,
+	"J4":  JumpSlot4,
+	"SA4": SegmentAbsolute4,
+	"SR4": SegmentRelative4,
 }
 
 func (rk relocationKind) String() string {
@@ -137,11 +299,30 @@ func (rk relocationKind) String() string {
 		return "A4"
 	case Relative4:
 		return "R4"
+	case GotLoad4:
+		return "GL4"
+	case GotOffset4:
+		return "GO4"
+	case PltCall4:
+		return "P4"
+	case BaseRelative4:
+		return "B4"
+	case JumpSlot4:
+		return "J4"
+	case SegmentAbsolute4:
+		return "SA4"
+	case SegmentRelative4:
+		return "SR4"
 	default:
 		return "?"
 	}
 }
 
+// IsSegmentRelative dice se ref è il numero di un segmento invece che di un simbolo
+func (rk relocationKind) IsSegmentRelative() bool {
+	return rk == SegmentAbsolute4 || rk == SegmentRelative4
+}
+
 func parseRelocationKind(kind string) (relocationKind, error) {
 	if v, ok := relocationKindParsingMap[kind]; ok {
 		return v, nil
@@ -159,13 +340,15 @@ type RelocationEntry struct {
 
 type SegmentData []byte
 
-// MyObjectFormat è il formato finale
+// MyObjectFormat è il formato finale.
+// Data ha un elemento per ogni segmento della SegmentTable, vuoto per i segmenti non presenti
 type MyObjectFormat struct {
 	Filename        string
 	Header          ObjHeader
 	SegmentTable    []*Segment
 	SymbolTable     []*Symbol
 	RelocationTable []RelocationEntry
+	Needed          []string // librerie condivise da caricare insieme a questo file
 	Data            []SegmentData
 }
 
@@ -181,7 +364,13 @@ func getNextLine(scanner *bufio.Scanner) (string, error) {
 
 	line := scanner.Text()
 	for strings.HasPrefix(line, "#") || strings.TrimSpace(line) == "" {
-		scanner.Scan()
+		// se il file finisce con dei commenti non devo ciclare all'infinito
+		if !scanner.Scan() {
+			if err := scanner.Err(); err != nil {
+				return "", fmt.Errorf("errore durante la lettura del file: %w", err)
+			}
+			return "", io.EOF
+		}
 		line = scanner.Text()
 	}
 
@@ -222,7 +411,28 @@ func ParseObjectFile(filename string) (*MyObjectFormat, error) {
 	if err != nil {
 		return nil, fmt.Errorf("errore nella lettura dell'header: %w", err)
 	}
-	fmt.Println("### HEADER", obj.Header)
+	// "There may be other information after the three numbers for extended versions of the linker"
+	headerFields := strings.Fields(objDims)
+	if len(headerFields) > 3 {
+		t, ok := objTypeParsingMap[headerFields[3]]
+		if !ok {
+			return nil, fmt.Errorf("tipo di file oggetto %s non riconosciuto", headerFields[3])
+		}
+		obj.Header.Type = t
+	}
+	if len(headerFields) > 4 {
+		_, err = fmt.Sscanf(headerFields[4], "%d", &obj.Header.NeededNum)
+		if err != nil {
+			return nil, fmt.Errorf("errore nella lettura del numero di librerie necessarie: %w", err)
+		}
+	}
+	if len(headerFields) > 5 {
+		_, err = fmt.Sscanf(headerFields[5], "%x", &obj.Header.EntryPoint)
+		if err != nil {
+			return nil, fmt.Errorf("errore nella lettura dell'entry point: %w", err)
+		}
+	}
+	fmt.Println("###", filename, "HEADER", obj.Header)
 
 	obj.SegmentTable = make([]*Segment, 0, obj.Header.SegmentNum)
 	obj.SymbolTable = make([]*Symbol, 0, obj.Header.SymbolNum)
@@ -246,9 +456,12 @@ func ParseObjectFile(filename string) (*MyObjectFormat, error) {
 		if err != nil {
 			return nil, err
 		}
+		if fields := strings.Fields(segmentString); len(fields) > 4 && !strings.HasPrefix(fields[4], "#") {
+			s.Group = fields[4]
+		}
 		obj.SegmentTable = append(obj.SegmentTable, &s)
 	}
-	fmt.Println("### Segmenti", obj.SegmentTable)
+	fmt.Println("###", filename, "Segmenti", obj.SegmentTable)
 
 	/* parsing dei simboli */
 	for i = 0; i < obj.Header.SymbolNum; i++ {
@@ -258,18 +471,26 @@ func ParseObjectFile(filename string) (*MyObjectFormat, error) {
 		}
 
 		var s Symbol
-		var kindString string
-		_, err = fmt.Sscanf(symbolString, "%s %x %d %s", &s.Name, &s.Value, &s.Segnum, &kindString)
+		var versionedName, kindString string
+		_, err = fmt.Sscanf(symbolString, "%s %x %d %s", &versionedName, &s.Value, &s.Segnum, &kindString)
 		if err != nil {
 			return nil, fmt.Errorf("errore nella lettura del simbolo %d -> %s: %w", i+1, symbolString, err)
 		}
-		s.Kind, err = parseSymbolKind(kindString)
+		err = parseSymbolName(&s, versionedName)
 		if err != nil {
 			return nil, err
 		}
+		s.Kind, s.Local, err = parseSymbolKind(kindString)
+		if err != nil {
+			return nil, err
+		}
+		// quello che c'è dopo un # è un commento, non una firma
+		if fields := strings.Fields(symbolString); len(fields) > 4 && !strings.HasPrefix(fields[4], "#") {
+			s.Signature = fields[4]
+		}
 		obj.SymbolTable = append(obj.SymbolTable, &s)
 	}
-	fmt.Println("### Simboli", obj.SymbolTable)
+	fmt.Println("###", filename, "Simboli", obj.SymbolTable)
 
 	/* parsing delle relocation entries */
 	for i = 0; i < obj.Header.RelocationEntriesNum; i++ {
@@ -290,11 +511,20 @@ func ParseObjectFile(filename string) (*MyObjectFormat, error) {
 		}
 		obj.RelocationTable = append(obj.RelocationTable, r)
 	}
-	fmt.Println("### Relocation entries", obj.RelocationTable)
+	fmt.Println("###", filename, "Relocation entries", obj.RelocationTable)
+
+	/* librerie condivise necessarie */
+	for i = 0; i < obj.Header.NeededNum; i++ {
+		neededString, err := getNextLine(scanner)
+		if err != nil {
+			return nil, err
+		}
+		obj.Needed = append(obj.Needed, strings.TrimSpace(neededString))
+	}
 
 	/* dati dei segmenti */
 	for _, seg := range obj.SegmentTable {
-		if seg.Flags[Present] {
+		if seg.Flags[Present] && seg.Length > 0 {
 			segmentDataHexString, err := getNextLine(scanner)
 			if err != nil {
 				return nil, err
@@ -304,10 +534,17 @@ func ParseObjectFile(filename string) (*MyObjectFormat, error) {
 				return nil, err
 			}
 			obj.Data = append(obj.Data, segmentData)
+		} else if seg.Flags[Present] {
+			// un segmento vuoto non ha una riga di dati, sarebbe una riga
+			// vuota che getNextLine salterebbe
+			obj.Data = append(obj.Data, SegmentData{})
 		} else {
 			// è un segmento non presente nell'oggetto (probabilmente bss)
 			// Potrei aggiungere un segmento pieno di zeri (quello che fà
-			/// il loader), ma non penso neanche mi serva
+			/// il loader), ma non penso neanche mi serva.
+			// Aggiungo comunque un elemento vuoto in modo che Data sia
+			// indicizzato esattamente come SegmentTable
+			obj.Data = append(obj.Data, nil)
 		}
 	}
 	// fmt.Println("### Dati", obj.Data)
@@ -328,19 +565,29 @@ func (obj *MyObjectFormat) WriteObjectFile(filename string) error {
 		return err
 	}
 	// header
-	_, err = fmt.Fprintf(f, "%d %d %d\n", obj.Header.SegmentNum, obj.Header.SymbolNum, obj.Header.RelocationEntriesNum)
+	_, err = fmt.Fprintf(f, "%d %d %d %s %d", obj.Header.SegmentNum, obj.Header.SymbolNum, obj.Header.RelocationEntriesNum, obj.Header.Type, obj.Header.NeededNum)
+	if err != nil {
+		return err
+	}
+	if obj.Header.Type == Executable || obj.Header.Type == RelocatableExecutable {
+		_, err = fmt.Fprintf(f, " %x", obj.Header.EntryPoint)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintln(f)
 	if err != nil {
 		return err
 	}
 	// segments
 	fmt.Fprintln(f, "# segments")
+	// NB: indirizzi, valori e loc sono in esadecimale come li legge ParseObjectFile
 	for _, seg := range obj.SegmentTable {
-		flags := ""
-		for flag := range seg.Flags {
-			flags += flag.String()
+		group := ""
+		if seg.Group != "" {
+			group = " " + seg.Group
 		}
-
-		_, err = fmt.Fprintf(f, "%s %d %d %s\n", seg.Name, seg.StartAddress, seg.Length, flags)
+		_, err = fmt.Fprintf(f, "%s %x %d %s%s\n", seg.Name, seg.StartAddress, seg.Length, FormatSegmentFlags(seg.Flags), group)
 		if err != nil {
 			return err
 		}
@@ -348,7 +595,15 @@ func (obj *MyObjectFormat) WriteObjectFile(filename string) error {
 	// symbols
 	fmt.Fprintln(f, "# symbols")
 	for _, sym := range obj.SymbolTable {
-		_, err = fmt.Fprintf(f, "%s %d %d %s\n", sym.Name, sym.Value, sym.Segnum, sym.Kind.String())
+		kind := sym.Kind.String()
+		if sym.Local {
+			kind += "L"
+		}
+		signature := ""
+		if sym.Signature != "" {
+			signature = " " + sym.Signature
+		}
+		_, err = fmt.Fprintf(f, "%s %x %d %s%s\n", sym.VersionedName(), sym.Value, sym.Segnum, kind, signature)
 		if err != nil {
 			return err
 		}
@@ -356,7 +611,17 @@ func (obj *MyObjectFormat) WriteObjectFile(filename string) error {
 	// relocatins
 	fmt.Fprintln(f, "# relocations")
 	for i := 0; i < int(obj.Header.RelocationEntriesNum); i++ {
-		_, err = fmt.Fprintf(f, "%d %d %d %s\n", obj.RelocationTable[i].Loc, obj.RelocationTable[i].Segnum, obj.RelocationTable[i].Ref, obj.RelocationTable[i].Kind.String())
+		_, err = fmt.Fprintf(f, "%x %d %d %s\n", obj.RelocationTable[i].Loc, obj.RelocationTable[i].Segnum, obj.RelocationTable[i].Ref, obj.RelocationTable[i].Kind.String())
+		if err != nil {
+			return err
+		}
+	}
+	// librerie necessarie
+	if obj.Header.NeededNum > 0 {
+		fmt.Fprintln(f, "# needed")
+	}
+	for i := 0; i < int(obj.Header.NeededNum); i++ {
+		_, err = fmt.Fprintln(f, obj.Needed[i])
 		if err != nil {
 			return err
 		}
@@ -364,8 +629,8 @@ func (obj *MyObjectFormat) WriteObjectFile(filename string) error {
 	// data
 	fmt.Fprintln(f, "# segment data")
 	for i, seg := range obj.SegmentTable {
-		if !seg.Flags[Present] {
-			// segmenti non presenti chiaramente
+		if !seg.Flags[Present] || seg.Length == 0 {
+			// segmenti non presenti (o vuoti) chiaramente
 			// non hanno nulla che va scritto
 			continue
 		}